@@ -1,9 +1,142 @@
 package chatProto
 
+import "time"
+
+const (
+	CMD_SEND_MSG_SINGLE      = "CMD_SEND_MSG_SINGLE"
+	CMD_GET_USERS            = "CMD_GET_USERS"
+	CMD_GET_USERS_RESPONSE   = "CMD_GET_USERS_RESPONSE"
+	CMD_USER_DISCONNECTED    = "CMD_USER_DISCONNECTED"
+	CMD_USER_CONNECTED       = "CMD_USER_CONNECTED"
+	CMD_GET_HISTORY          = "CMD_GET_HISTORY"
+	CMD_GET_HISTORY_RESPONSE = "CMD_GET_HISTORY_RESPONSE"
+	CMD_AUTH_CHALLENGE       = "CMD_AUTH_CHALLENGE"
+	CMD_AUTH_RESPONSE        = "CMD_AUTH_RESPONSE"
+	CMD_AUTH_OK              = "CMD_AUTH_OK"
+	CMD_CONN_REJECTED        = "CMD_CONN_REJECTED"
+	CMD_SEND_MSG_ROOM        = "CMD_SEND_MSG_ROOM"
+	CMD_CREATE_ROOM          = "CMD_CREATE_ROOM"
+	CMD_JOIN_ROOM            = "CMD_JOIN_ROOM"
+	CMD_LEAVE_ROOM           = "CMD_LEAVE_ROOM"
+	CMD_INVITE_TO_ROOM       = "CMD_INVITE_TO_ROOM"
+	CMD_GET_ROOMS            = "CMD_GET_ROOMS"
+	CMD_GET_ROOMS_RESPONSE   = "CMD_GET_ROOMS_RESPONSE"
+	CMD_ROOM_UPDATED         = "CMD_ROOM_UPDATED"
+	CMD_ACK                  = "CMD_ACK"
+	CMD_DELIVERED            = "CMD_DELIVERED"
+	CMD_READ                 = "CMD_READ"
+	CMD_TYPING               = "CMD_TYPING"
+	CMD_HELLO                = "CMD_HELLO"
+	CMD_HELLO_OK             = "CMD_HELLO_OK"
+	CMD_ERROR                = "CMD_ERROR"
+	CMD_CHANGE_NICK          = "CMD_CHANGE_NICK"
+	CMD_USER_UPDATED         = "CMD_USER_UPDATED"
+	CMD_UPDATE_PROFILE       = "CMD_UPDATE_PROFILE"
+	CMD_SET_PRESENCE         = "CMD_SET_PRESENCE"
+)
+
+// version of the protocol spoken by this build. Clients older than
+// MIN_PROTOCOL_VERSION are rejected
+const (
+	PROTOCOL_VERSION     = 1
+	MIN_PROTOCOL_VERSION = 1
+)
+
+// optional features agreed on in the hello. The messages of a feature are
+// only sent to clients that asked for it
+const (
+	CAP_ROOMS    = "rooms"
+	CAP_RECEIPTS = "receipts"
+	CAP_TYPING   = "typing"
+	CAP_PROFILES = "profiles"
+	CAP_PRESENCE = "presence"
+)
+
+// features implemented by this build
+var CAPABILITIES = []string{CAP_ROOMS, CAP_RECEIPTS, CAP_TYPING, CAP_PROFILES, CAP_PRESENCE}
+
+// CapabilityOf returns the feature a command belongs to, "" for the ones
+// every client understands
+func CapabilityOf(cmd string) string {
+	switch cmd {
+	case CMD_SEND_MSG_ROOM, CMD_CREATE_ROOM, CMD_JOIN_ROOM, CMD_LEAVE_ROOM, CMD_INVITE_TO_ROOM,
+		CMD_GET_ROOMS, CMD_GET_ROOMS_RESPONSE, CMD_ROOM_UPDATED:
+		return CAP_ROOMS
+	case CMD_DELIVERED, CMD_READ:
+		return CAP_RECEIPTS
+	case CMD_CHANGE_NICK, CMD_UPDATE_PROFILE, CMD_USER_UPDATED:
+		return CAP_PROFILES
+	case CMD_SET_PRESENCE:
+		return CAP_PRESENCE
+	case CMD_TYPING:
+		return CAP_TYPING
+	}
+	return ""
+}
+
+// encodings of the frames after the handshake, a client lists the ones it
+// accepts in the hello by order of preference
+const (
+	CODEC_JSON   = "json"
+	CODEC_BINARY = "binary"
+)
+
+// why a request failed, sent in the ErrorInfo of a CMD_ERROR
 const (
-	CMD_SEND_MSG_SINGLE    = "CMD_SEND_MSG_SINGLE"
-	CMD_GET_USERS          = "CMD_GET_USERS"
-	CMD_GET_USERS_RESPONSE = "CMD_GET_USERS_RESPONSE"
-	CMD_USER_DISCONNECTED  = "CMD_USER_DISCONNECTED"
-	CMD_USER_CONNECTED     = "CMD_USER_CONNECTED"
+	ERR_BAD_REQUEST      = "ERR_BAD_REQUEST"
+	ERR_UNKNOWN_COMMAND  = "ERR_UNKNOWN_COMMAND"
+	ERR_UNKNOWN_RECEIVER = "ERR_UNKNOWN_RECEIVER"
+	ERR_UNKNOWN_ROOM     = "ERR_UNKNOWN_ROOM"
+	ERR_NOT_A_MEMBER     = "ERR_NOT_A_MEMBER"
+	ERR_RATE_LIMITED     = "ERR_RATE_LIMITED"
+	ERR_NICK_TAKEN       = "ERR_NICK_TAKEN"
+	ERR_NICK_INVALID     = "ERR_NICK_INVALID"
+	ERR_AVATAR_INVALID   = "ERR_AVATAR_INVALID"
+	ERR_INTERNAL         = "ERR_INTERNAL"
 )
+
+// why a connection was refused, sent in the Rejection of a CMD_CONN_REJECTED
+const (
+	REJECT_VERSION   = "REJECT_VERSION"
+	REJECT_HANDSHAKE = "REJECT_HANDSHAKE"
+	REJECT_AUTH      = "REJECT_AUTH"
+	// the nickname is used by another online user or not allowed, the user
+	// has to pick another one
+	REJECT_NICK_TAKEN   = "REJECT_NICK_TAKEN"
+	REJECT_NICK_INVALID = "REJECT_NICK_INVALID"
+)
+
+// nicknames are made of letters, digits and '_'. They are unique among the
+// online users regardless of case
+const MAX_NICK_LENGTH = 20
+
+// presence of a user next to its status text. An invisible user looks offline
+// to the others
+const (
+	PRESENCE_ONLINE    = "online"
+	PRESENCE_AWAY      = "away"
+	PRESENCE_BUSY      = "busy"
+	PRESENCE_INVISIBLE = "invisible"
+)
+
+// max number of characters of a status text
+const MAX_STATUS_LENGTH = 80
+
+// max number of messages returned by one CMD_GET_HISTORY
+const HISTORY_PAGE_SIZE = 50
+
+// a CMD_TYPING is resent every TYPING_INTERVAL while the user keeps typing
+// and the indicator goes away TYPING_TIMEOUT after the last one
+const (
+	TYPING_INTERVAL = 2 * time.Second
+	TYPING_TIMEOUT  = 5 * time.Second
+)
+
+// max time to write a frame before the connection is considered dead
+const WRITE_TIMEOUT = 10 * time.Second
+
+// size in bytes of the random challenge signed by clients to authenticate
+const AUTH_CHALLENGE_SIZE = 32
+
+// http path on the chat server where avatars are fetched, followed by their hash
+const AVATAR_PATH = "/avatar/"
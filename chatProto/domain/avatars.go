@@ -0,0 +1,126 @@
+package domain
+
+import (
+	"example/zerochat/chatProto"
+	"example/zerochat/client/config"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// how long to wait before asking again for an avatar the server didn't give
+	AVATAR_RETRY_DELAY   = time.Minute
+	AVATAR_FETCH_TIMEOUT = 10 * time.Second
+	// avatars are scaled down before being sent, anything bigger is not one
+	MAX_AVATAR_SIZE = 1 << 20
+)
+
+// Avatar returns the avatar of the user. Avatars are fetched from the server
+// by their hash the first time they are needed and kept on disk, meanwhile
+// nil is returned and EVENT_AVATAR is published once it arrived
+func (client *Client) Avatar(user *User) []byte {
+	hash := user.AvatarHash
+	if !isAvatarHash(hash) {
+		// servers that still send the avatar inside the messages
+		return user.Avatar
+	}
+
+	client.avatarsMutex.Lock()
+	defer client.avatarsMutex.Unlock()
+	if avatar, ok := client.avatars[hash]; ok {
+		return avatar
+	}
+	if last, ok := client.avatarAttempts[hash]; ok && time.Since(last) < AVATAR_RETRY_DELAY {
+		return nil
+	}
+	client.avatarAttempts[hash] = time.Now()
+	if avatar, err := os.ReadFile(client.avatarPath(hash)); err == nil && AvatarHash(avatar) == hash {
+		client.avatars[hash] = avatar
+		return avatar
+	}
+	go client.fetchAvatar(hash)
+	return nil
+}
+
+// cacheAvatar keeps an avatar we already have, like our own
+func (client *Client) cacheAvatar(avatar []byte) {
+	if hash := AvatarHash(avatar); hash != "" {
+		client.avatarsMutex.Lock()
+		client.avatars[hash] = avatar
+		client.avatarsMutex.Unlock()
+	}
+}
+
+// newAvatarClient returns the http client all the avatars are fetched with,
+// so its idle connections are reused instead of piling up
+func newAvatarClient(cfg config.Config) (*http.Client, error) {
+	tlsCfg, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout:   AVATAR_FETCH_TIMEOUT,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}, nil
+}
+
+func (client *Client) fetchAvatar(hash string) {
+	if client.avatarClient == nil {
+		log.Printf("failed to fetch avatar %s: no http client\n", hash)
+		return
+	}
+	u := serverURL(client.cfg, false, chatProto.AVATAR_PATH+hash)
+	resp, err := client.avatarClient.Get(u.String())
+	if err != nil {
+		log.Printf("failed to fetch avatar %s: %s\n", hash, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("failed to fetch avatar %s: %s\n", hash, resp.Status)
+		return
+	}
+	avatar, err := io.ReadAll(io.LimitReader(resp.Body, MAX_AVATAR_SIZE))
+	if err != nil {
+		log.Printf("failed to read avatar %s: %s\n", hash, err)
+		return
+	}
+	if AvatarHash(avatar) != hash {
+		log.Printf("failed to fetch avatar %s: content doesn't match the hash\n", hash)
+		return
+	}
+
+	// without a disk cache it is fetched again on the next start, no big deal
+	if err := os.MkdirAll(client.cfg.AvatarCachePath, 0o755); err != nil {
+		log.Printf("failed to create avatar cache %s: %s\n", client.cfg.AvatarCachePath, err)
+	} else if err := os.WriteFile(client.avatarPath(hash), avatar, 0o644); err != nil {
+		log.Printf("failed to cache avatar %s: %s\n", hash, err)
+	}
+
+	client.avatarsMutex.Lock()
+	client.avatars[hash] = avatar
+	client.avatarsMutex.Unlock()
+	client.publish(Event{Type: EVENT_AVATAR})
+}
+
+func (client *Client) avatarPath(hash string) string {
+	return filepath.Join(client.cfg.AvatarCachePath, hash)
+}
+
+// isAvatarHash tells if the hash is one of ours, it becomes a file name so
+// anything else sent by the server must not be trusted
+func isAvatarHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
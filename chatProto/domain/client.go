@@ -3,124 +3,494 @@ package domain
 import (
 	"encoding/json"
 	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/errors"
 	"example/zerochat/client/config"
 	"fmt"
 	"log"
-	"net/url"
+	"net/http"
+	"sync"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/google/uuid"
 )
 
 type Client struct {
-	User          *User
-	Draft         []*Message
-	WriteChan     chan *Message
-	ActiveUsers   map[string]*User
-	ChatHistory   map[string]ChatHistory
-	Notifications []Notification
+	identity  *Identity
+	WriteChan chan *Message
+	cfg       config.Config
+
+	// the state below is written by the connection and read by the UI
+	mutex         sync.RWMutex
+	user          *User // as the server references us, replaced when it changes
+	drafts        []*Message
+	activeUsers   map[string]*User
+	rooms         map[string]*Room
+	history       map[string]ChatHistory       // keyed by user id or room id
+	typing        map[string]map[string]Typing // keyed by conversation then user id
+	notifications []Notification
+	connection    Connection
+	// messages sent by us that can still get a receipt, keyed by message id
+	sent map[string]*Message
+	// last sequence number after which missing messages were asked for
+	gaps map[string]uint64
+	// features agreed on with the server in the hello
+	capabilities map[string]bool
+	lastError    error
+	lastErrorAt  time.Time
+	// callers of Request waiting for a response, keyed by request id
+	pending map[string]chan *Message
+	// the presence we chose, and whether it is away because we were not looking
+	presence  Presence
+	autoAway  bool
+	focused   bool
+	awayTimer *time.Timer
+
+	subscribersMutex sync.Mutex
+	subscribers      map[int]func(Event)
+	nextSubscriber   int
+
+	// avatars by hash and when each was last fetched
+	avatars        map[string][]byte
+	avatarAttempts map[string]time.Time
+	avatarsMutex   sync.Mutex
+	// nil when the TLS config could not be read
+	avatarClient *http.Client
+
+	// messages waiting for a connection to be written
+	outbox      []*Message
+	outboxMutex sync.Mutex
+	outboxReady chan struct{}
 }
 
-func (client *Client) connectToChatServer(hostPort string, callback func(error)) {
-	u := url.URL{Scheme: "ws", Host: hostPort, Path: "/chat"}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Printf("failed to dial websocket server %s", err)
-		callback(err)
-		return
+// handleMessage applies a message received from the server to the state of
+// the client and tells the subscribers what changed
+func (client *Client) handleMessage(message *Message) {
+	client.mutex.Lock()
+	events := client.apply(message)
+	waiting, ok := client.pending[message.RequestId]
+	delete(client.pending, message.RequestId)
+	client.mutex.Unlock()
+	client.publish(events...)
+	if ok {
+		waiting <- message
 	}
-	defer c.Close()
-
-	// send the current user to server
-	c.WriteJSON(client.User)
+}
 
-	go func() {
-		for msg := range client.WriteChan {
-			err := c.WriteJSON(msg)
-			if err != nil {
-				log.Printf("failed writing json to websocket: %s\n", err)
-				break
+// apply changes the state according to the message. The caller must hold the mutex
+func (client *Client) apply(message *Message) []Event {
+	switch message.Type {
+	case chatProto.CMD_GET_USERS_RESPONSE:
+		log.Printf("request current active users on server\n")
+		users := make([]*User, 0)
+		err := json.Unmarshal(message.Content, &users)
+		if err != nil {
+			log.Printf("failed to unmarshall json with users %s\n", err)
+			return nil
+		}
+		clear(client.activeUsers)
+		for _, u := range users {
+			client.activeUsers[u.Id] = u
+			client.requestHistory(u)
+		}
+		log.Printf("active users: %v\n", client.activeUsers)
+		return []Event{{Type: EVENT_USERS}}
+	case chatProto.CMD_SEND_MSG_SINGLE:
+		if message.Sender.Id == client.user.Id {
+			return client.addSentElsewhere(message)
+		}
+		log.Printf("got message from %s:%s\n", message.Sender.Id, message.Sender.Name)
+		client.stopTyping(message.Sender.Id, &message.Sender)
+		if !client.addToHistory(message.Sender.Id, message) {
+			// replayed after a reconnect
+			return []Event{{Type: EVENT_TYPING, Conversation: message.Sender.Id}}
+		}
+		history := client.history[message.Sender.Id]
+		history.Unread = true
+		client.history[message.Sender.Id] = history
+		notif := Notification{User: &message.Sender, Message: string(message.Content)}
+		client.notifications = append(client.notifications, notif)
+		return []Event{
+			{Type: EVENT_TYPING, Conversation: message.Sender.Id},
+			{Type: EVENT_HISTORY, Conversation: message.Sender.Id},
+			{Type: EVENT_NOTIFICATION},
+		}
+	case chatProto.CMD_SEND_MSG_ROOM:
+		room, ok := client.rooms[message.Room]
+		if !ok {
+			log.Printf("got message for unknown room %s\n", message.Room)
+			return nil
+		}
+		if message.Sender.Id == client.user.Id {
+			return client.addSentElsewhere(message)
+		}
+		log.Printf("got message from %s in room %s\n", &message.Sender, room)
+		client.stopTyping(room.Id, &message.Sender)
+		if !client.addToHistory(room.Id, message) {
+			return []Event{{Type: EVENT_TYPING, Conversation: room.Id}}
+		}
+		history := client.history[room.Id]
+		history.Unread = true
+		client.history[room.Id] = history
+		notif := Notification{
+			User:    &message.Sender,
+			Message: fmt.Sprintf("(%s) %s", room.Name, message.Content),
+		}
+		client.notifications = append(client.notifications, notif)
+		return []Event{
+			{Type: EVENT_TYPING, Conversation: room.Id},
+			{Type: EVENT_HISTORY, Conversation: room.Id},
+			{Type: EVENT_NOTIFICATION},
+		}
+	case chatProto.CMD_GET_ROOMS_RESPONSE:
+		rooms := make([]*Room, 0)
+		err := json.Unmarshal(message.Content, &rooms)
+		if err != nil {
+			log.Printf("failed to unmarshall json with rooms %s\n", err)
+			return nil
+		}
+		clear(client.rooms)
+		for _, room := range rooms {
+			client.rooms[room.Id] = room
+			if room.HasMember(client.user.Id) {
+				client.requestRoomHistory(room)
 			}
 		}
-		log.Println("exit gorutine that reads from write channel")
-	}()
-
-	for {
-		var message Message
-		err := c.ReadJSON(&message)
+		log.Printf("rooms: %v\n", client.rooms)
+		return []Event{{Type: EVENT_ROOMS}}
+	case chatProto.CMD_ROOM_UPDATED:
+		var room Room
+		err := json.Unmarshal(message.Content, &room)
 		if err != nil {
-			log.Printf("failed to read %s\n", err)
-			break
+			log.Printf("failed to unmarshall json with room %s\n", err)
+			return nil
 		}
-
-		switch message.Type {
-		case chatProto.CMD_GET_USERS_RESPONSE:
-			log.Printf("request current active users on server\n")
-			users := make([]*User, 0)
-			err := json.Unmarshal(message.Content, &users)
-			if err != nil {
-				log.Printf("failed to unmarshall json with users %s\n", err)
-				continue
+		client.updateRoom(&room)
+		return []Event{
+			{Type: EVENT_ROOMS},
+			{Type: EVENT_HISTORY, Conversation: room.Id},
+		}
+	case chatProto.CMD_TYPING:
+		conversation := message.Sender.Id
+		if message.Room != "" {
+			conversation = message.Room
+		}
+		if client.typing[conversation] == nil {
+			client.typing[conversation] = make(map[string]Typing)
+		}
+		client.typing[conversation][message.Sender.Id] = Typing{
+			User:    &message.Sender,
+			Expires: time.Now().Add(chatProto.TYPING_TIMEOUT),
+		}
+		return []Event{{Type: EVENT_TYPING, Conversation: conversation}}
+	case chatProto.CMD_ACK:
+		if sent, ok := client.sent[message.Id]; ok && message.Seq != 0 {
+			// now we know where the server placed it
+			sent.Seq = message.Seq
+			sent.Timestamp = message.Timestamp
+			client.sortHistory(client.conversationOf(sent))
+		}
+		return client.updateStatus(message.Id, STATUS_SENT)
+	case chatProto.CMD_DELIVERED:
+		return client.updateStatus(message.Id, STATUS_DELIVERED)
+	case chatProto.CMD_READ:
+		// everything we sent up to the receipt has been read
+		var events []Event
+		for _, m := range client.history[message.Sender.Id].Messages {
+			if m.Sender.Id == client.user.Id {
+				events = append(events, client.updateStatus(m.Id, STATUS_READ)...)
 			}
-			clear(client.ActiveUsers)
-			for _, u := range users {
-				client.ActiveUsers[u.Id] = u
+			if m.Id == message.Id {
+				break
 			}
-			log.Printf("active users: %v\n", client.ActiveUsers)
-		case chatProto.CMD_SEND_MSG_SINGLE:
-			log.Printf("got message from %s:%s\n", message.Sender.Id, message.Sender.Name)
-			history := client.ChatHistory[message.Sender.Id]
-			history.Messages = append(
-				history.Messages,
-				&message,
-			)
-			history.Unread = true
-			client.ChatHistory[message.Sender.Id] = history
-			notif := Notification{User: &message.Sender, Message: string(message.Content)}
-			client.Notifications = append(client.Notifications, notif)
-		case chatProto.CMD_USER_CONNECTED:
-			log.Printf("User %s:%s connected\n", message.Sender.Id, message.Sender.Name)
-			client.ActiveUsers[message.Sender.Id] = &message.Sender
-			client.ChatHistory[message.Sender.Id] = ChatHistory{
-				Messages: make([]*Message, 0),
-				Unread:   false,
+		}
+		return events
+	case chatProto.CMD_ERROR:
+		var info ErrorInfo
+		if err := json.Unmarshal(message.Content, &info); err != nil {
+			log.Printf("failed to unmarshall json with error %s\n", err)
+			return nil
+		}
+		log.Printf("server refused %s: %s %s\n", info.Command, info.Code, info.Reason)
+		client.lastError = requestError(&info)
+		client.lastErrorAt = time.Now()
+		if info.Command == chatProto.CMD_SET_PRESENCE {
+			// back to the presence the server knows
+			client.presence = Presence{State: client.user.Presence, Text: client.user.StatusText}
+			client.autoAway = false
+		}
+		events := []Event{{Type: EVENT_ERROR}}
+		if sent, ok := client.sent[message.Id]; ok {
+			sent.Status = STATUS_FAILED
+			delete(client.sent, message.Id)
+			events = append(events, Event{Type: EVENT_HISTORY, Conversation: client.conversationOf(sent)})
+		}
+		return events
+	case chatProto.CMD_USER_CONNECTED:
+		log.Printf("User %s:%s connected\n", message.Sender.Id, message.Sender.Name)
+		client.activeUsers[message.Sender.Id] = &message.Sender
+		client.requestHistory(&message.Sender)
+		log.Printf("active users: %v\n", client.activeUsers)
+		return []Event{{Type: EVENT_USERS}}
+	case chatProto.CMD_GET_HISTORY_RESPONSE:
+		var page HistoryPage
+		err := json.Unmarshal(message.Content, &page)
+		if err != nil {
+			log.Printf("failed to unmarshall json with history %s\n", err)
+			return nil
+		}
+		conversation := message.Reciever.Id
+		if message.Room != "" {
+			conversation = message.Room
+		}
+		log.Printf("got %d messages of history of %s\n", len(page.Messages), conversation)
+		for _, m := range page.Messages {
+			if m.Sender.Id == client.user.Id {
+				m.Status = STATUS_SENT
 			}
-			log.Printf("active users: %v\n", client.ActiveUsers)
-		case chatProto.CMD_USER_DISCONNECTED:
-			log.Printf("User %s:%s disconnected\n", message.Sender.Id, message.Sender.Name)
-			delete(client.ActiveUsers, message.Sender.Id)
-			delete(client.ChatHistory, message.Sender.Id)
-			log.Printf("active users: %v\n", client.ActiveUsers)
 		}
-		callback(nil)
+		// after a reconnect the page overlaps with what we already have
+		if !client.addToHistory(conversation, page.Messages...) {
+			return nil
+		}
+		return []Event{{Type: EVENT_HISTORY, Conversation: conversation}}
+	case chatProto.CMD_USER_UPDATED:
+		log.Printf("User %s:%s updated\n", message.Sender.Id, message.Sender.Name)
+		return client.updateUser(&message.Sender)
+	case chatProto.CMD_USER_DISCONNECTED:
+		log.Printf("User %s:%s disconnected\n", message.Sender.Id, message.Sender.Name)
+		delete(client.activeUsers, message.Sender.Id)
+		delete(client.history, message.Sender.Id)
+		delete(client.gaps, message.Sender.Id)
+		log.Printf("active users: %v\n", client.activeUsers)
+		return []Event{
+			{Type: EVENT_USERS},
+			{Type: EVENT_HISTORY, Conversation: message.Sender.Id},
+		}
+	}
+	return nil
+}
+
+// requestError maps the content of a CMD_ERROR to the error shown to the user
+func requestError(info *ErrorInfo) error {
+	if info.Code == chatProto.ERR_BAD_REQUEST {
+		// the server could not make sense of what we wrote
+		return errors.WSFrameBuildError(info.Reason)
+	}
+	return errors.ChatServerRequestError{Code: info.Code, Reason: info.Reason}
+}
+
+// Send writes a chat message to the server, adds it to its conversation and
+// tracks its receipts
+func (client *Client) Send(msg *Message) {
+	if msg.Id == "" {
+		msg.Id = uuid.New().String()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	msg.Status = STATUS_PENDING
+
+	client.mutex.Lock()
+	conversation := client.conversationOf(msg)
+	client.sent[msg.Id] = msg
+	client.addToHistory(conversation, msg)
+	client.mutex.Unlock()
+
+	client.publish(Event{Type: EVENT_HISTORY, Conversation: conversation})
+	// the writer gets its own copy, receipts change the one in the history
+	out := *msg
+	client.WriteChan <- &out
+}
+
+// MarkRead clears the unread flag of the conversation and, when it is with a
+// user, tells them up to which message we read it
+func (client *Client) MarkRead(conversation string) {
+	client.mutex.Lock()
+	history, ok := client.history[conversation]
+	if !ok || !history.Unread {
+		client.mutex.Unlock()
+		return
+	}
+	history.Unread = false
+	client.history[conversation] = history
+	peer, isUser := client.activeUsers[conversation]
+	me := client.user
+	var last *Message
+	for i := len(history.Messages) - 1; isUser && i >= 0; i-- {
+		if history.Messages[i].Sender.Id == peer.Id && history.Messages[i].Id != "" {
+			last = history.Messages[i]
+			break
+		}
+	}
+	client.mutex.Unlock()
+
+	client.publish(Event{Type: EVENT_HISTORY, Conversation: conversation})
+	if last != nil && client.Supports(chatProto.CAP_RECEIPTS) && !client.invisible() {
+		client.WriteChan <- &Message{
+			Type:     chatProto.CMD_READ,
+			Id:       last.Id,
+			Sender:   *me,
+			Reciever: *peer,
+		}
+	}
+}
+
+// SendTyping tells the peer or the members of the room that we are typing
+func (client *Client) SendTyping(peer *User, roomId string) {
+	if !client.Supports(chatProto.CAP_TYPING) || client.invisible() {
+		return
+	}
+	msg := &Message{
+		Type:   chatProto.CMD_TYPING,
+		Sender: *client.User(),
+		Room:   roomId,
+	}
+	if peer != nil {
+		msg.Reciever = *peer
+	}
+	client.WriteChan <- msg
+}
+
+// stopTyping drops the indicator of the user once its message arrived
+func (client *Client) stopTyping(conversation string, user *User) {
+	delete(client.typing[conversation], user.Id)
+}
+
+// updateStatus moves a sent message forward to the status of a receipt
+func (client *Client) updateStatus(id string, status MessageStatus) []Event {
+	msg, ok := client.sent[id]
+	if !ok {
+		return nil
+	}
+	if msg.Status < status {
+		msg.Status = status
+	}
+	if status == STATUS_READ {
+		delete(client.sent, id)
+	}
+	return []Event{{Type: EVENT_HISTORY, Conversation: client.conversationOf(msg)}}
+}
+
+// updateRoom replaces the state of the room and loads or drops its
+// conversation when we joined or left it. The caller must hold the mutex
+func (client *Client) updateRoom(room *Room) {
+	previous, known := client.rooms[room.Id]
+	wasMember := known && previous.HasMember(client.user.Id)
+	isMember := room.HasMember(client.user.Id)
+
+	if len(room.Members) == 0 {
+		delete(client.rooms, room.Id)
+	} else {
+		client.rooms[room.Id] = room
+	}
+	if isMember && !wasMember {
+		log.Printf("joined room %s\n", room)
+		client.history[room.Id] = ChatHistory{Messages: make([]*Message, 0)}
+		client.requestRoomHistory(room)
+	} else if !isMember && wasMember {
+		log.Printf("left room %s\n", room)
+		delete(client.history, room.Id)
+		delete(client.gaps, room.Id)
+	}
+}
+
+func (client *Client) CreateRoom(name string) {
+	client.WriteChan <- &Message{
+		Type:    chatProto.CMD_CREATE_ROOM,
+		Sender:  *client.User(),
+		Content: []byte(name),
+	}
+}
+
+func (client *Client) JoinRoom(roomId string) {
+	client.WriteChan <- &Message{
+		Type:   chatProto.CMD_JOIN_ROOM,
+		Sender: *client.User(),
+		Room:   roomId,
+	}
+}
+
+func (client *Client) LeaveRoom(roomId string) {
+	client.WriteChan <- &Message{
+		Type:   chatProto.CMD_LEAVE_ROOM,
+		Sender: *client.User(),
+		Room:   roomId,
+	}
+}
+
+func (client *Client) InviteToRoom(roomId string, user *User) {
+	client.WriteChan <- &Message{
+		Type:     chatProto.CMD_INVITE_TO_ROOM,
+		Sender:   *client.User(),
+		Reciever: *user,
+		Room:     roomId,
+	}
+}
+
+// requestRoomHistory asks the server for the latest messages of the room
+func (client *Client) requestRoomHistory(room *Room) {
+	query, err := json.Marshal(&HistoryQuery{Limit: chatProto.HISTORY_PAGE_SIZE})
+	if err != nil {
+		log.Printf("failed to marshall history query %s\n", err)
+		return
+	}
+	client.WriteChan <- &Message{
+		Type:    chatProto.CMD_GET_HISTORY,
+		Sender:  *client.user,
+		Room:    room.Id,
+		Content: query,
+	}
+}
+
+// requestHistory asks the server for the latest messages exchanged with peer
+func (client *Client) requestHistory(peer *User) {
+	query, err := json.Marshal(&HistoryQuery{Limit: chatProto.HISTORY_PAGE_SIZE})
+	if err != nil {
+		log.Printf("failed to marshall history query %s\n", err)
+		return
+	}
+	client.WriteChan <- &Message{
+		Type:     chatProto.CMD_GET_HISTORY,
+		Sender:   *client.user,
+		Reciever: *peer,
+		Content:  query,
 	}
-	close(client.WriteChan)
-	log.Println("exit gorutine connectToChatServer")
 }
 
 func InitClientConnection(
-	nickName string,
-	avatar []byte,
+	identity *Identity,
 	cfg config.Config,
-	callback func(error),
+	onChange func(Event),
 ) *Client {
-	// First connect to the client
-	hostPort := fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)
-	user := CreateUser(nickName, avatar)
+	user := identity.User().Ref()
 	client := &Client{
-		User:        user,
-		Draft:       make([]*Message, 0),
-		WriteChan:   make(chan *Message, 1),
-		ActiveUsers: make(map[string]*User),
-		ChatHistory: make(map[string]ChatHistory),
+		identity:       identity,
+		user:           &user,
+		WriteChan:      make(chan *Message, 1),
+		cfg:            cfg,
+		drafts:         make([]*Message, 0),
+		activeUsers:    make(map[string]*User),
+		rooms:          make(map[string]*Room),
+		history:        make(map[string]ChatHistory),
+		typing:         make(map[string]map[string]Typing),
+		sent:           make(map[string]*Message),
+		gaps:           make(map[string]uint64),
+		capabilities:   make(map[string]bool),
+		pending:        make(map[string]chan *Message),
+		subscribers:    make(map[int]func(Event)),
+		outboxReady:    make(chan struct{}, 1),
+		avatars:        make(map[string][]byte),
+		avatarAttempts: make(map[string]time.Time),
 	}
-	go client.connectToChatServer(hostPort, callback)
-
-	// Then execute first command to get all users
-	// After this command the server will send messages when clients connect or disconnect
-	msg := Message{
-		Type:   chatProto.CMD_GET_USERS,
-		Sender: *client.User,
+	client.cacheAvatar(identity.Avatar)
+	if avatarClient, err := newAvatarClient(cfg); err != nil {
+		log.Printf("failed to create the avatar http client %s\n", err)
+	} else {
+		client.avatarClient = avatarClient
 	}
-	client.WriteChan <- &msg
+	// subscribed before connecting so no change is missed
+	client.Subscribe(onChange)
+	go client.forwardWrites()
+	go client.stayConnected(cfg)
 	return client
 }
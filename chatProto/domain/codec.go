@@ -0,0 +1,203 @@
+package domain
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec turns messages into websocket frames and back. Both sides agree on
+// one in the hello. The handshake itself is always JSON, the agreed codec is
+// used from the first message after CMD_AUTH_OK
+type Codec interface {
+	Name() string
+	// websocket.TextMessage or websocket.BinaryMessage
+	FrameType() int
+	Marshal(msg *Message) ([]byte, error)
+	Unmarshal(data []byte, msg *Message) error
+}
+
+// CodecByName returns the codec with the name used in the hello
+func CodecByName(name string) (Codec, bool) {
+	switch name {
+	case chatProto.CODEC_JSON:
+		return jsonCodec{}, true
+	case chatProto.CODEC_BINARY:
+		return binaryCodec{}, true
+	}
+	return nil, false
+}
+
+func WriteMessage(c *websocket.Conn, codec Codec, msg *Message) error {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(codec.FrameType(), data)
+}
+
+func ReadMessage(c *websocket.Conn, codec Codec, msg *Message) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, msg)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return chatProto.CODEC_JSON
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Marshal(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+// format of the frames of the binary codec, written as their first byte
+const BINARY_CODEC_VERSION = 3
+
+// binaryCodec writes the fields of a message one after the other. Strings and
+// byte slices are prefixed by their length as a uvarint, so unlike JSON the
+// avatars and the content are not base64 encoded
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return chatProto.CODEC_BINARY
+}
+
+func (binaryCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (binaryCodec) Marshal(msg *Message) ([]byte, error) {
+	size := 64 + len(msg.Content) + len(msg.Sender.Avatar) + len(msg.Reciever.Avatar)
+	buf := make([]byte, 0, size)
+	buf = append(buf, BINARY_CODEC_VERSION)
+	buf = appendBytes(buf, []byte(msg.Id))
+	buf = appendBytes(buf, []byte(msg.Type))
+	buf = appendUser(buf, &msg.Sender)
+	buf = appendUser(buf, &msg.Reciever)
+	buf = appendBytes(buf, []byte(msg.Room))
+	buf = appendBytes(buf, msg.Content)
+	var nanos int64
+	if !msg.Timestamp.IsZero() {
+		nanos = msg.Timestamp.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, nanos)
+	buf = binary.AppendUvarint(buf, msg.Seq)
+	buf = appendBytes(buf, []byte(msg.RequestId))
+	return buf, nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, msg *Message) error {
+	if len(data) == 0 || data[0] != BINARY_CODEC_VERSION {
+		return fmt.Errorf("unknown binary frame format")
+	}
+	r := &binaryReader{data: data[1:]}
+	msg.Id = r.string()
+	msg.Type = r.string()
+	r.user(&msg.Sender)
+	r.user(&msg.Reciever)
+	msg.Room = r.string()
+	msg.Content = r.bytes()
+	msg.Timestamp = time.Time{}
+	if nanos := r.varint(); nanos != 0 {
+		msg.Timestamp = time.Unix(0, nanos).UTC()
+	}
+	msg.Seq = r.uvarint()
+	msg.RequestId = r.string()
+	if r.err != nil {
+		return fmt.Errorf("failed to decode binary frame %s", r.err)
+	}
+	return nil
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendUser(buf []byte, user *User) []byte {
+	buf = appendBytes(buf, []byte(user.Id))
+	buf = appendBytes(buf, []byte(user.Name))
+	buf = appendBytes(buf, user.Avatar)
+	buf = appendBytes(buf, []byte(user.AvatarHash))
+	buf = appendBytes(buf, user.PublicKey)
+	buf = appendBytes(buf, []byte(user.Presence))
+	return appendBytes(buf, []byte(user.StatusText))
+}
+
+// binaryReader reads the fields of a binary frame in order. After the first
+// error every read returns a zero value and err keeps that error
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed uvarint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// bytes returns a slice of the frame, which is not reused by the websocket
+func (r *binaryReader) bytes() []byte {
+	size := r.uvarint()
+	if r.err != nil || size == 0 {
+		return nil
+	}
+	if size > uint64(len(r.data)) {
+		r.err = fmt.Errorf("field of %d bytes in %d bytes left", size, len(r.data))
+		return nil
+	}
+	b := r.data[:size]
+	r.data = r.data[size:]
+	return b
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) user(user *User) {
+	user.Id = r.string()
+	user.Name = r.string()
+	user.Avatar = r.bytes()
+	user.AvatarHash = r.string()
+	user.PublicKey = r.bytes()
+	user.Presence = r.string()
+	user.StatusText = r.string()
+}
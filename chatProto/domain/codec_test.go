@@ -0,0 +1,137 @@
+package domain
+
+import (
+	"bytes"
+	"example/zerochat/chatProto"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testMessage is a chat message as the server forwards it, with an avatar
+// in its sender like the replies to CMD_GET_USERS carry them
+func testMessage() *Message {
+	return &Message{
+		Id:   "0b6e1c9a-3f1d-4c55-9a57-4c3b5e0d2f11",
+		Type: chatProto.CMD_SEND_MSG_SINGLE,
+		Sender: User{
+			Id:         "5a1f6a0e-2b47-4c8e-8d65-0f7e2f9c1a22",
+			Name:       "alice",
+			Avatar:     bytes.Repeat([]byte{0xff, 0xd8, 0x42}, 10*1024),
+			AvatarHash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			PublicKey:  bytes.Repeat([]byte{7}, 32),
+			Presence:   chatProto.PRESENCE_BUSY,
+			StatusText: "in a meeting",
+		},
+		Reciever: User{
+			Id:         "c3d2e1f0-1a2b-4c3d-8e9f-a0b1c2d3e4f5",
+			Name:       "bob",
+			AvatarHash: "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752",
+			PublicKey:  bytes.Repeat([]byte{9}, 32),
+		},
+		Room:      "room-1",
+		Content:   []byte("hello there, how are you doing today?"),
+		Timestamp: time.Date(2024, 5, 17, 10, 30, 0, 123, time.UTC),
+		Seq:       42,
+		RequestId: "7",
+	}
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"full", testMessage()},
+		{"empty", &Message{}},
+		{"no timestamp", &Message{Type: chatProto.CMD_GET_USERS, Sender: User{Id: "a", Name: "alice"}, RequestId: "1"}},
+	}
+	codec := binaryCodec{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := codec.Marshal(test.msg)
+			if err != nil {
+				t.Fatalf("failed to marshal %s", err)
+			}
+			var got Message
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("failed to unmarshal %s", err)
+			}
+			if !reflect.DeepEqual(&got, test.msg) {
+				t.Errorf("got %+v, want %+v", &got, test.msg)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	codec := binaryCodec{}
+	data, err := codec.Marshal(testMessage())
+	if err != nil {
+		t.Fatalf("failed to marshal %s", err)
+	}
+	// every field is read in order, so any cut misses part of one
+	for size := 0; size < len(data); size++ {
+		var msg Message
+		if err := codec.Unmarshal(data[:size], &msg); err == nil {
+			t.Fatalf("no error for a frame cut at %d of %d bytes", size, len(data))
+		}
+	}
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown version", []byte{BINARY_CODEC_VERSION + 1, 0}},
+		{"json", []byte(`{"Type":"SEND_MSG_SINGLE"}`)},
+		{"overflowing uvarint", append([]byte{BINARY_CODEC_VERSION}, bytes.Repeat([]byte{0xff}, 11)...)},
+		{"field longer than the frame", []byte{BINARY_CODEC_VERSION, 100, 'a', 'b'}},
+		{"huge field", []byte{BINARY_CODEC_VERSION, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+	}
+	codec := binaryCodec{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var msg Message
+			if err := codec.Unmarshal(test.data, &msg); err == nil {
+				t.Errorf("no error for %v", test.data)
+			}
+		})
+	}
+}
+
+func benchmarkMarshal(b *testing.B, codec Codec) {
+	msg := testMessage()
+	data, _ := codec.Marshal(msg)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := codec.Marshal(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkUnmarshal(b *testing.B, codec Codec) {
+	data, err := codec.Marshal(testMessage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var msg Message
+		if err := codec.Unmarshal(data, &msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalJSON(b *testing.B)     { benchmarkMarshal(b, jsonCodec{}) }
+func BenchmarkMarshalBinary(b *testing.B)   { benchmarkMarshal(b, binaryCodec{}) }
+func BenchmarkUnmarshalJSON(b *testing.B)   { benchmarkUnmarshal(b, jsonCodec{}) }
+func BenchmarkUnmarshalBinary(b *testing.B) { benchmarkUnmarshal(b, binaryCodec{}) }
@@ -0,0 +1,358 @@
+package domain
+
+import (
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/errors"
+	"example/zerochat/client/config"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type ConnectionState int
+
+const (
+	STATE_CONNECTING ConnectionState = iota
+	STATE_ONLINE
+	STATE_RETRYING
+	STATE_OFFLINE
+)
+
+// delays between two attempts to reconnect, doubled after every failure
+const (
+	RECONNECT_MIN_DELAY = time.Second
+	RECONNECT_MAX_DELAY = time.Minute
+)
+
+// max number of messages kept while offline, the oldest are dropped first
+const OUTBOX_SIZE = 500
+
+type Connection struct {
+	State ConnectionState
+	// when the next attempt happens while retrying
+	RetryAt time.Time
+	// why the last session ended, a rejection is a ChatServerConnectionError
+	Err error
+}
+
+func (conn Connection) String() string {
+	switch conn.State {
+	case STATE_CONNECTING:
+		return "Connecting"
+	case STATE_ONLINE:
+		return "Online"
+	case STATE_RETRYING:
+		seconds := math.Ceil(time.Until(conn.RetryAt).Seconds())
+		return fmt.Sprintf("Retrying in %.0fs", max(seconds, 0))
+	default:
+		return "Offline"
+	}
+}
+
+// stayConnected keeps a session with the server, reconnecting with a jittered
+// exponential backoff. It only gives up when the server rejects us
+func (client *Client) stayConnected(cfg config.Config) {
+	delay := RECONNECT_MIN_DELAY
+	for {
+		client.setConnection(Connection{State: STATE_CONNECTING})
+
+		err := client.connectToChatServer(cfg)
+		if isRejection(err) {
+			client.setConnection(Connection{State: STATE_OFFLINE, Err: err})
+			return
+		}
+
+		// we got through the handshake so start over with short delays
+		if client.Connection().State == STATE_ONLINE {
+			delay = RECONNECT_MIN_DELAY
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Printf("connection lost, retrying in %s\n", wait)
+		client.setConnection(Connection{State: STATE_RETRYING, RetryAt: time.Now().Add(wait), Err: err})
+		time.Sleep(wait)
+		delay = min(delay*2, RECONNECT_MAX_DELAY)
+	}
+}
+
+// connectToChatServer runs one session with the server and returns why it ended
+func (client *Client) connectToChatServer(cfg config.Config) error {
+	tlsCfg, err := tlsConfig(cfg)
+	if err != nil {
+		log.Printf("%s\n", err)
+		return err
+	}
+	u := serverURL(cfg, true, "/chat")
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = cfg.Compression
+	dialer.TLSClientConfig = tlsCfg
+	c, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		log.Printf("failed to dial websocket server %s", err)
+		return err
+	}
+	defer c.Close()
+	if cfg.Compression {
+		if err := c.SetCompressionLevel(cfg.CompressionLevel); err != nil {
+			log.Printf("failed to set compression level %d: %s\n", cfg.CompressionLevel, err)
+		}
+	}
+
+	// agree on the protocol, then prove we are really the user we claim to be
+	codec, err := client.hello(c, cfg)
+	if err != nil {
+		log.Printf("failed handshake %s", err)
+		return err
+	}
+	if err := client.authenticate(c); err != nil {
+		log.Printf("failed to authenticate %s", err)
+		return err
+	}
+
+	// Then execute first commands to get all users and rooms. After this the
+	// server sends messages when clients connect or disconnect.
+	// The writer below is not running yet so it is safe to write here
+	client.dropStaleRequests()
+	WriteMessage(c, codec, withRequestId(&Message{Type: chatProto.CMD_GET_USERS, Sender: *client.User()}))
+	if client.Supports(chatProto.CAP_ROOMS) {
+		WriteMessage(c, codec, withRequestId(&Message{Type: chatProto.CMD_GET_ROOMS, Sender: *client.User()}))
+	}
+	client.setConnection(Connection{State: STATE_ONLINE})
+
+	done := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		client.writeLoop(c, codec, cfg, done)
+		close(writerDone)
+	}()
+	defer func() {
+		close(done)
+		<-writerDone
+	}()
+
+	// a missed pong makes the read below fail which ends the session
+	ExpectPongs(c, cfg.PongTimeout)
+	for {
+		var message Message
+		err := ReadMessage(c, codec, &message)
+		if err != nil {
+			log.Printf("failed to read %s\n", err)
+			return errors.WSFrameReadError(err.Error())
+		}
+		client.handleMessage(&message)
+	}
+}
+
+// writeLoop writes the messages of the outbox to the connection and pings
+// the server until done is closed or a write fails
+func (client *Client) writeLoop(c *websocket.Conn, codec Codec, cfg config.Config, done <-chan struct{}) {
+	pings, stop := Heartbeat(cfg.PingInterval)
+	defer stop()
+	for {
+		for msg := client.nextQueued(); msg != nil; msg = client.nextQueued() {
+			c.SetWriteDeadline(time.Now().Add(chatProto.WRITE_TIMEOUT))
+			err := WriteMessage(c, codec, msg)
+			if err != nil {
+				log.Printf("failed writing to websocket: %s\n", err)
+				// keep it for the next session and make the read loop stop
+				client.requeue(msg)
+				c.Close()
+				return
+			}
+		}
+		select {
+		case <-client.outboxReady:
+		case <-pings:
+			if err := Ping(c); err != nil {
+				log.Printf("failed to ping server: %s\n", err)
+				c.Close()
+				return
+			}
+		case <-done:
+			log.Println("exit gorutine that writes to the websocket")
+			return
+		}
+	}
+}
+
+// forwardWrites moves everything sent on WriteChan to the outbox so callers
+// never block, even while there is no connection
+func (client *Client) forwardWrites() {
+	for msg := range client.WriteChan {
+		withRequestId(msg)
+		client.outboxMutex.Lock()
+		if len(client.outbox) >= OUTBOX_SIZE {
+			log.Printf("outbox full, dropping %s\n", client.outbox[0].Type)
+			client.outbox = client.outbox[1:]
+		}
+		client.outbox = append(client.outbox, msg)
+		client.outboxMutex.Unlock()
+
+		select {
+		case client.outboxReady <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (client *Client) nextQueued() *Message {
+	client.outboxMutex.Lock()
+	defer client.outboxMutex.Unlock()
+	if len(client.outbox) == 0 {
+		return nil
+	}
+	msg := client.outbox[0]
+	client.outbox = client.outbox[1:]
+	return msg
+}
+
+func (client *Client) requeue(msg *Message) {
+	client.outboxMutex.Lock()
+	defer client.outboxMutex.Unlock()
+	client.outbox = append([]*Message{msg}, client.outbox...)
+}
+
+// dropStaleRequests removes from the outbox what a new session asks again
+// anyway, so only the messages written while offline are replayed
+func (client *Client) dropStaleRequests() {
+	client.outboxMutex.Lock()
+	defer client.outboxMutex.Unlock()
+	kept := client.outbox[:0]
+	for _, msg := range client.outbox {
+		switch msg.Type {
+		case chatProto.CMD_GET_USERS, chatProto.CMD_GET_ROOMS, chatProto.CMD_GET_HISTORY, chatProto.CMD_TYPING:
+		default:
+			kept = append(kept, msg)
+		}
+	}
+	if len(kept) > 0 {
+		log.Printf("replaying %d messages written while offline\n", len(kept))
+	}
+	client.outbox = kept
+}
+
+// hello tells the server which protocol version, features and codecs we
+// speak, keeps the features the server agreed on and returns the codec to use
+// once authenticated
+func (client *Client) hello(c *websocket.Conn, cfg config.Config) (Codec, error) {
+	codecs := []string{chatProto.CODEC_BINARY, chatProto.CODEC_JSON}
+	if cfg.Codec == chatProto.CODEC_JSON {
+		codecs = []string{chatProto.CODEC_JSON}
+	}
+	offer, err := json.Marshal(&Hello{
+		Version:      chatProto.PROTOCOL_VERSION,
+		Capabilities: chatProto.CAPABILITIES,
+		Codecs:       codecs,
+	})
+	if err != nil {
+		return nil, errors.WSFrameBuildError(err.Error())
+	}
+	// the only message carrying our avatar and key, the server keeps them
+	err = c.WriteJSON(withRequestId(&Message{Type: chatProto.CMD_HELLO, Sender: *client.helloUser(), Content: offer}))
+	if err != nil {
+		return nil, errors.WSFrameBuildError(err.Error())
+	}
+
+	var answer Message
+	if err := c.ReadJSON(&answer); err != nil {
+		return nil, errors.WSFrameReadError(err.Error())
+	}
+	switch answer.Type {
+	case chatProto.CMD_HELLO_OK:
+	case chatProto.CMD_CONN_REJECTED:
+		return nil, rejectionError(&answer)
+	default:
+		return nil, errors.ChatServerConnectionError(fmt.Sprintf("unexpected %s during handshake", answer.Type))
+	}
+	var agreed Hello
+	if err := json.Unmarshal(answer.Content, &agreed); err != nil {
+		return nil, errors.WSFrameReadError(err.Error())
+	}
+	codec, ok := CodecByName(chatProto.CODEC_JSON)
+	if len(agreed.Codecs) > 0 {
+		codec, ok = CodecByName(agreed.Codecs[0])
+	}
+	if !ok {
+		return nil, errors.ChatServerConnectionError(fmt.Sprintf("server picked unknown codec %v", agreed.Codecs))
+	}
+	log.Printf("speaking protocol version %d in %s with %v\n", agreed.Version, codec.Name(), agreed.Capabilities)
+
+	client.mutex.Lock()
+	clear(client.capabilities)
+	for _, capability := range agreed.Capabilities {
+		client.capabilities[capability] = true
+	}
+	// the presence the server gave us, replaced as the user may be read elsewhere
+	me := *client.user
+	me.Presence = answer.Reciever.Presence
+	me.StatusText = answer.Reciever.StatusText
+	client.user = &me
+	client.mutex.Unlock()
+	return codec, nil
+}
+
+// rejectionError turns a CMD_CONN_REJECTED into the error telling why
+func rejectionError(message *Message) error {
+	var rejection Rejection
+	if err := json.Unmarshal(message.Content, &rejection); err != nil {
+		return errors.ChatServerConnectionError(message.Content)
+	}
+	switch rejection.Code {
+	case chatProto.REJECT_VERSION:
+		return errors.ProtocolVersionError(rejection.Reason)
+	case chatProto.REJECT_NICK_TAKEN, chatProto.REJECT_NICK_INVALID:
+		return errors.NickNameError(rejection.Reason)
+	}
+	return errors.ChatServerConnectionError(rejection.Reason)
+}
+
+// isRejection reports if the server refused us, in which case retrying is useless
+func isRejection(err error) bool {
+	switch err.(type) {
+	case errors.ChatServerConnectionError, errors.ProtocolVersionError, errors.NickNameError:
+		return true
+	}
+	return false
+}
+
+// authenticate answers the challenge of the server. A rejection from the
+// server is returned as a ChatServerConnectionError
+func (client *Client) authenticate(c *websocket.Conn) error {
+	var challenge Message
+	if err := c.ReadJSON(&challenge); err != nil {
+		return errors.WSFrameReadError(err.Error())
+	}
+	switch challenge.Type {
+	case chatProto.CMD_AUTH_CHALLENGE:
+	case chatProto.CMD_CONN_REJECTED:
+		return rejectionError(&challenge)
+	default:
+		return errors.ChatServerConnectionError(fmt.Sprintf("unexpected %s during handshake", challenge.Type))
+	}
+
+	err := c.WriteJSON(withRequestId(&Message{
+		Type:    chatProto.CMD_AUTH_RESPONSE,
+		Sender:  *client.User(),
+		Content: client.identity.SignChallenge(challenge.Content),
+	}))
+	if err != nil {
+		return errors.WSFrameBuildError(err.Error())
+	}
+
+	var result Message
+	if err := c.ReadJSON(&result); err != nil {
+		return errors.WSFrameReadError(err.Error())
+	}
+	switch result.Type {
+	case chatProto.CMD_AUTH_OK:
+		return nil
+	case chatProto.CMD_CONN_REJECTED:
+		return rejectionError(&result)
+	default:
+		return errors.ChatServerConnectionError(fmt.Sprintf("unexpected %s during handshake", result.Type))
+	}
+}
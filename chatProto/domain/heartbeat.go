@@ -0,0 +1,35 @@
+package domain
+
+import (
+	"example/zerochat/chatProto"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ExpectPongs makes reads on the connection fail when the peer doesn't
+// answer our pings within timeout. A zero timeout disables the check
+func ExpectPongs(c *websocket.Conn, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(timeout))
+	})
+}
+
+// Heartbeat returns a channel that ticks every time a ping has to be sent and
+// a function to stop it. A zero interval returns a channel that never ticks
+func Heartbeat(interval time.Duration) (<-chan time.Time, func()) {
+	if interval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// Ping can be called concurrently with the writes of messages
+func Ping(c *websocket.Conn) error {
+	return c.WriteControl(websocket.PingMessage, nil, time.Now().Add(chatProto.WRITE_TIMEOUT))
+}
@@ -0,0 +1,133 @@
+package domain
+
+import (
+	"cmp"
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"log"
+	"math"
+	"slices"
+)
+
+// addToHistory puts the messages in the conversation ordered by sequence
+// number, skipping the ones already there, and asks the server for what is
+// missing in between. It reports if the conversation changed. The caller must
+// hold the mutex
+func (client *Client) addToHistory(conversation string, messages ...*Message) bool {
+	history := client.history[conversation]
+	changed := false
+	for _, m := range messages {
+		if known := findMessage(history.Messages, m); known != nil {
+			// our own message came back from the server before its ack
+			if known.Seq == 0 && m.Seq != 0 {
+				known.Seq = m.Seq
+				known.Timestamp = m.Timestamp
+				changed = true
+			}
+			continue
+		}
+		history.Messages = append(history.Messages, m)
+		changed = true
+	}
+	if !changed {
+		return false
+	}
+	client.history[conversation] = history
+	client.sortHistory(conversation)
+	return true
+}
+
+// sortHistory orders the conversation again once sequence numbers changed.
+// The caller must hold the mutex
+func (client *Client) sortHistory(conversation string) {
+	slices.SortStableFunc(client.history[conversation].Messages, compareSeq)
+	client.fillGap(conversation)
+}
+
+// findMessage returns the message of the conversation with the same id or
+// the same sequence number as m
+func findMessage(messages []*Message, m *Message) *Message {
+	for _, known := range messages {
+		if (m.Id != "" && known.Id == m.Id) || (m.Seq != 0 && known.Seq == m.Seq) {
+			return known
+		}
+	}
+	return nil
+}
+
+// compareSeq orders messages by sequence number. The ones not accepted by the
+// server yet have none and stay at the end in the order they were sent
+func compareSeq(a, b *Message) int {
+	seqA, seqB := a.Seq, b.Seq
+	if seqA == 0 {
+		seqA = math.MaxUint64
+	}
+	if seqB == 0 {
+		seqB = math.MaxUint64
+	}
+	return cmp.Compare(seqA, seqB)
+}
+
+// fillGap asks for the messages missing after the first hole in the sequence
+// numbers of the conversation. A hole is asked for only once so a server that
+// lost messages is not asked forever. The caller must hold the mutex
+func (client *Client) fillGap(conversation string) {
+	messages := client.history[conversation].Messages
+	for i := 1; i < len(messages); i++ {
+		prev, next := messages[i-1].Seq, messages[i].Seq
+		if prev == 0 || next == 0 || next == prev+1 {
+			continue
+		}
+		if client.gaps[conversation] == prev {
+			return
+		}
+		client.gaps[conversation] = prev
+		log.Printf("messages %d to %d of %s are missing\n", prev+1, next-1, conversation)
+		client.requestSince(conversation, prev)
+		return
+	}
+}
+
+// requestSince asks for the messages of the conversation that follow the
+// sequence number after
+func (client *Client) requestSince(conversation string, after uint64) {
+	query, err := json.Marshal(&HistoryQuery{Limit: chatProto.HISTORY_PAGE_SIZE, After: after})
+	if err != nil {
+		log.Printf("failed to marshall history query %s\n", err)
+		return
+	}
+	msg := &Message{
+		Type:    chatProto.CMD_GET_HISTORY,
+		Sender:  *client.user,
+		Content: query,
+	}
+	if _, ok := client.rooms[conversation]; ok {
+		msg.Room = conversation
+	} else {
+		msg.Reciever = User{Id: conversation}
+	}
+	client.WriteChan <- msg
+}
+
+// addSentElsewhere records a message we sent from another session of our
+// user, its receipts are tracked like ours. The caller must hold the mutex
+func (client *Client) addSentElsewhere(message *Message) []Event {
+	conversation := client.conversationOf(message)
+	message.Status = STATUS_SENT
+	if !client.addToHistory(conversation, message) {
+		return nil
+	}
+	client.sent[message.Id] = message
+	return []Event{{Type: EVENT_HISTORY, Conversation: conversation}}
+}
+
+// conversationOf returns the id of the room or of the peer of the message
+func (client *Client) conversationOf(message *Message) string {
+	if message.Room != "" {
+		return message.Room
+	}
+	if message.Sender.Id == client.user.Id {
+		return message.Reciever.Id
+	}
+	return message.Sender.Id
+}
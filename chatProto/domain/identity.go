@@ -0,0 +1,92 @@
+package domain
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// Identity is the durable profile of the local user. It is saved next to the
+// config file so the same user is recognised by the server after a restart
+type Identity struct {
+	Id         string
+	Name       string
+	Avatar     []byte
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+func CreateIdentity() (*Identity, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate keypair %s", err)
+	}
+	return &Identity{
+		Id:         uuid.New().String(),
+		PublicKey:  public,
+		PrivateKey: private,
+	}, nil
+}
+
+// LoadIdentity reads the profile file. The returned error wraps
+// os.ErrNotExist when there is no profile yet
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile %w", err)
+	}
+	var identity Identity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("failed to unmarshall profile %s", err)
+	}
+	if identity.Id == "" || len(identity.PrivateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("profile %s is incomplete", path)
+	}
+	identity.PublicKey = identity.PrivateKey.Public().(ed25519.PublicKey)
+	return &identity, nil
+}
+
+func (identity *Identity) Save(path string) error {
+	data, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshall profile %s", err)
+	}
+	// the file holds the private key so only the owner can read it
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write profile %s", err)
+	}
+	return nil
+}
+
+// SignChallenge proves to the server that we own the private key of the identity
+func (identity *Identity) SignChallenge(challenge []byte) []byte {
+	return ed25519.Sign(identity.PrivateKey, challengePayload(identity.Id, challenge))
+}
+
+// VerifyChallenge checks the signature of the challenge against the public key of the user
+func VerifyChallenge(user *User, challenge []byte, signature []byte) bool {
+	if len(user.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(user.PublicKey, challengePayload(user.Id, challenge), signature)
+}
+
+// the id is part of the signed payload so a signature can't be replayed for another user
+func challengePayload(id string, challenge []byte) []byte {
+	return append([]byte(id+":"), challenge...)
+}
+
+// User returns the public part of the identity that is shared with the server
+func (identity *Identity) User() *User {
+	return &User{
+		Id:         identity.Id,
+		Name:       identity.Name,
+		Avatar:     identity.Avatar,
+		AvatarHash: AvatarHash(identity.Avatar),
+		PublicKey:  identity.PublicKey,
+	}
+}
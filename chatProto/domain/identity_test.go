@@ -0,0 +1,42 @@
+package domain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVerifyChallenge(t *testing.T) {
+	alice, err := CreateIdentity()
+	if err != nil {
+		t.Fatalf("failed to create identity %s", err)
+	}
+	mallory, err := CreateIdentity()
+	if err != nil {
+		t.Fatalf("failed to create identity %s", err)
+	}
+	challenge := bytes.Repeat([]byte{1}, 32)
+	signature := alice.SignChallenge(challenge)
+
+	tests := []struct {
+		name      string
+		user      *User
+		challenge []byte
+		signature []byte
+		want      bool
+	}{
+		{"valid", alice.User(), challenge, signature, true},
+		{"other challenge", alice.User(), bytes.Repeat([]byte{2}, 32), signature, false},
+		{"signed by someone else", alice.User(), challenge, mallory.SignChallenge(challenge), false},
+		{"replayed for another id", &User{Id: mallory.Id, PublicKey: alice.PublicKey}, challenge, signature, false},
+		{"no public key", &User{Id: alice.Id}, challenge, signature, false},
+		{"short public key", &User{Id: alice.Id, PublicKey: alice.PublicKey[:16]}, challenge, signature, false},
+		{"no signature", alice.User(), challenge, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := VerifyChallenge(test.user, test.challenge, test.signature); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
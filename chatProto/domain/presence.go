@@ -0,0 +1,102 @@
+package domain
+
+import (
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"log"
+	"time"
+)
+
+// SetPresence changes how the others see us, the server is told again after
+// every reconnection
+func (client *Client) SetPresence(state string, text string) {
+	client.mutex.Lock()
+	client.presence = Presence{State: state, Text: text}
+	client.autoAway = false
+	presence := client.presence
+	client.mutex.Unlock()
+	client.sendPresence(presence)
+}
+
+// Focus tells if the user is looking at the chat. Online users turn away
+// after cfg.AwayAfter without it and back online when they return
+func (client *Client) Focus(focused bool) {
+	client.mutex.Lock()
+	client.focused = focused
+	if client.awayTimer != nil {
+		client.awayTimer.Stop()
+		client.awayTimer = nil
+	}
+	if !focused && client.cfg.AwayAfter > 0 {
+		client.awayTimer = time.AfterFunc(client.cfg.AwayAfter, client.goAway)
+	}
+	back := focused && client.autoAway
+	if back {
+		client.autoAway = false
+		client.presence.State = chatProto.PRESENCE_ONLINE
+	}
+	presence := client.presence
+	client.mutex.Unlock()
+
+	if back {
+		client.sendPresence(presence)
+	}
+}
+
+// goAway turns an online user away, busy and invisible users stay so
+func (client *Client) goAway() {
+	client.mutex.Lock()
+	state := client.presence.State
+	if client.focused || (state != "" && state != chatProto.PRESENCE_ONLINE) {
+		client.mutex.Unlock()
+		return
+	}
+	client.autoAway = true
+	client.presence.State = chatProto.PRESENCE_AWAY
+	presence := client.presence
+	client.mutex.Unlock()
+
+	log.Printf("away after %s without focus\n", client.cfg.AwayAfter)
+	client.sendPresence(presence)
+}
+
+func (client *Client) sendPresence(presence Presence) {
+	if !client.Supports(chatProto.CAP_PRESENCE) {
+		return
+	}
+	content, err := json.Marshal(&presence)
+	if err != nil {
+		log.Printf("failed to marshall presence %s\n", err)
+		return
+	}
+	client.WriteChan <- &Message{
+		Type:    chatProto.CMD_SET_PRESENCE,
+		Sender:  *client.User(),
+		Content: content,
+	}
+}
+
+// invisible reports if we chose to look offline, then we don't tell that we
+// are typing or reading either
+func (client *Client) invisible() bool {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.presence.State == chatProto.PRESENCE_INVISIBLE
+}
+
+// helloUser is who we say we are in the hello, with the presence we chose
+func (client *Client) helloUser() *User {
+	user := client.identity.User()
+	client.mutex.RLock()
+	user.Presence = client.presence.State
+	user.StatusText = client.presence.Text
+	client.mutex.RUnlock()
+	return user
+}
+
+// Presence is the state and status text we chose
+func (client *Client) Presence() Presence {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.presence
+}
@@ -0,0 +1,77 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/errors"
+	"example/zerochat/client/config"
+	"log"
+)
+
+// ChangeNickName asks the server to rename us. Once accepted User returns the
+// new name, a refusal ends up in LastError
+func (client *Client) ChangeNickName(name string) {
+	if !client.Supports(chatProto.CAP_PROFILES) {
+		log.Printf("can't change nickname, the server does not support it\n")
+		return
+	}
+	client.WriteChan <- &Message{
+		Type:    chatProto.CMD_CHANGE_NICK,
+		Sender:  *client.User(),
+		Content: []byte(name),
+	}
+}
+
+// UpdateProfile changes our nickname and avatar and waits for the server to
+// accept them, everyone else is told by the server
+func (client *Client) UpdateProfile(ctx context.Context, name string, avatar []byte) error {
+	if !client.Supports(chatProto.CAP_PROFILES) {
+		return errors.ChatServerRequestError{Code: chatProto.ERR_UNKNOWN_COMMAND, Reason: "the server can't update profiles"}
+	}
+	content, err := json.Marshal(&Profile{Name: name, Avatar: avatar})
+	if err != nil {
+		return errors.WSFrameBuildError(err.Error())
+	}
+	// no need to fetch it back once the server references it
+	client.cacheAvatar(avatar)
+	_, err = client.Request(ctx, &Message{
+		Type:    chatProto.CMD_UPDATE_PROFILE,
+		Sender:  *client.User(),
+		Content: content,
+	})
+	return err
+}
+
+// updateUser replaces a user whose profile changed. The caller must hold the mutex
+func (client *Client) updateUser(user *User) []Event {
+	var events []Event
+	if _, ok := client.activeUsers[user.Id]; ok {
+		client.activeUsers[user.Id] = user
+		events = append(events, Event{Type: EVENT_USERS})
+	}
+	if user.Id == client.user.Id {
+		log.Printf("we are now %s\n", user)
+		client.user = user
+		// another session may have changed our presence, we keep it from now on
+		if user.Presence != client.presence.State || user.StatusText != client.presence.Text {
+			client.presence = Presence{State: user.Presence, Text: user.StatusText}
+			client.autoAway = false
+		}
+		// the next hello and the next start use the new profile
+		client.identity.Name = user.Name
+		if user.AvatarHash != AvatarHash(client.identity.Avatar) {
+			client.avatarsMutex.Lock()
+			avatar, ok := client.avatars[user.AvatarHash]
+			client.avatarsMutex.Unlock()
+			if ok || user.AvatarHash == "" {
+				client.identity.Avatar = avatar
+			}
+		}
+		if err := client.identity.Save(config.PROFILE_FILE); err != nil {
+			log.Printf("failed to save profile %s\n", err)
+		}
+		events = append(events, Event{Type: EVENT_PROFILE})
+	}
+	return events
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"example/zerochat/chatProto"
+
+	"github.com/google/uuid"
+)
+
+// Request writes the message to the server and waits for the response with
+// the same request id. A CMD_ERROR answer is returned as an error. The wait
+// ends with the context, the message may still be sent later on
+func (client *Client) Request(ctx context.Context, msg *Message) (*Message, error) {
+	withRequestId(msg)
+	response := make(chan *Message, 1)
+	client.mutex.Lock()
+	client.pending[msg.RequestId] = response
+	client.mutex.Unlock()
+	defer func() {
+		client.mutex.Lock()
+		delete(client.pending, msg.RequestId)
+		client.mutex.Unlock()
+	}()
+
+	client.WriteChan <- msg
+	select {
+	case resp := <-response:
+		if resp.Type == chatProto.CMD_ERROR {
+			var info ErrorInfo
+			if err := json.Unmarshal(resp.Content, &info); err != nil {
+				return nil, err
+			}
+			return nil, requestError(&info)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// withRequestId gives the message a request id unless it already has one
+func withRequestId(msg *Message) *Message {
+	if msg.RequestId == "" {
+		msg.RequestId = uuid.New().String()
+	}
+	return msg
+}
@@ -0,0 +1,223 @@
+package domain
+
+import (
+	"example/zerochat/chatProto"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EventType tells subscribers which part of the state of the client changed
+type EventType int
+
+const (
+	EVENT_USERS EventType = iota
+	EVENT_ROOMS
+	EVENT_HISTORY // of Event.Conversation
+	EVENT_TYPING  // in Event.Conversation
+	EVENT_NOTIFICATION
+	EVENT_CONNECTION
+	EVENT_ERROR
+	EVENT_AVATAR  // fetched, ask Client.Avatar again
+	EVENT_PROFILE // ours changed, see Client.User
+)
+
+type Event struct {
+	Type EventType
+	// user id or room id the event is about, if any
+	Conversation string
+}
+
+// Subscribe calls fn after every change of the state until the returned
+// function is called. fn runs on the goroutine that made the change, after
+// the state is unlocked, so it can read the state but must return quickly
+func (client *Client) Subscribe(fn func(Event)) func() {
+	client.subscribersMutex.Lock()
+	defer client.subscribersMutex.Unlock()
+	id := client.nextSubscriber
+	client.nextSubscriber++
+	client.subscribers[id] = fn
+	return func() {
+		client.subscribersMutex.Lock()
+		defer client.subscribersMutex.Unlock()
+		delete(client.subscribers, id)
+	}
+}
+
+// publish calls the subscribers with the events. The state must not be locked
+func (client *Client) publish(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	client.subscribersMutex.Lock()
+	subscribers := make([]func(Event), 0, len(client.subscribers))
+	for _, fn := range client.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	client.subscribersMutex.Unlock()
+
+	for _, event := range events {
+		for _, fn := range subscribers {
+			fn(event)
+		}
+	}
+}
+
+// User returns ourselves as the server references us. It is replaced, never
+// changed, when our profile changes
+func (client *Client) User() *User {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.user
+}
+
+// ActiveUsers returns the users connected to the server
+func (client *Client) ActiveUsers() []*User {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	users := make([]*User, 0, len(client.activeUsers))
+	for _, u := range client.activeUsers {
+		users = append(users, u)
+	}
+	return users
+}
+
+func (client *Client) ActiveUser(id string) (*User, bool) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	u, ok := client.activeUsers[id]
+	return u, ok
+}
+
+// FindUser returns the active user with the nickname, ignoring case
+func (client *Client) FindUser(name string) (*User, bool) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	for _, u := range client.activeUsers {
+		if strings.EqualFold(u.Name, name) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// Rooms returns every room known by the server, joined or not
+func (client *Client) Rooms() []*Room {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	rooms := make([]*Room, 0, len(client.rooms))
+	for _, room := range client.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+func (client *Client) Room(id string) (*Room, bool) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	room, ok := client.rooms[id]
+	return room, ok
+}
+
+// History returns a copy of the conversation with a user or in a room. The
+// messages are copies too since receipts keep changing their status
+func (client *Client) History(conversation string) (ChatHistory, bool) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	history, ok := client.history[conversation]
+	if !ok {
+		return ChatHistory{Messages: []*Message{}}, false
+	}
+	return ChatHistory{Messages: copyMessages(history.Messages), Unread: history.Unread}, true
+}
+
+// Drafts returns the notes written in the conversation with ourselves
+func (client *Client) Drafts() []*Message {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return copyMessages(client.drafts)
+}
+
+// SaveDraft keeps a note in the conversation with ourselves. It is never sent
+func (client *Client) SaveDraft(text string) {
+	client.mutex.Lock()
+	me := client.user
+	client.drafts = append(client.drafts, &Message{
+		Type:      chatProto.CMD_SEND_MSG_SINGLE,
+		Sender:    *me,
+		Reciever:  *me,
+		Content:   []byte(text),
+		Timestamp: time.Now(),
+	})
+	client.mutex.Unlock()
+	client.publish(Event{Type: EVENT_HISTORY, Conversation: me.Id})
+}
+
+// TakeNotifications returns the notifications not shown yet and forgets them
+func (client *Client) TakeNotifications() []Notification {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	notifications := client.notifications
+	client.notifications = nil
+	return notifications
+}
+
+func (client *Client) Connection() Connection {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.connection
+}
+
+// LastError returns the last request refused by the server and when it was
+func (client *Client) LastError() (error, time.Time) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.lastError, client.lastErrorAt
+}
+
+// Supports reports if the server agreed on the feature in the hello
+func (client *Client) Supports(capability string) bool {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	return client.capabilities[capability]
+}
+
+func (client *Client) setConnection(conn Connection) {
+	client.mutex.Lock()
+	client.connection = conn
+	client.mutex.Unlock()
+	client.publish(Event{Type: EVENT_CONNECTION})
+}
+
+// TypingIn returns the names of the users typing in the conversation, sorted,
+// and when the first of the indicators expires
+func (client *Client) TypingIn(conversation string) ([]string, time.Time) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	var names []string
+	var expires time.Time
+	now := time.Now()
+	for id, typing := range client.typing[conversation] {
+		if typing.Expires.Before(now) {
+			delete(client.typing[conversation], id)
+			continue
+		}
+		names = append(names, typing.User.Name)
+		if expires.IsZero() || typing.Expires.Before(expires) {
+			expires = typing.Expires
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	return names, expires
+}
+
+func copyMessages(messages []*Message) []*Message {
+	res := make([]*Message, len(messages))
+	for i, m := range messages {
+		c := *m
+		res[i] = &c
+	}
+	return res
+}
@@ -0,0 +1,45 @@
+package domain
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"example/zerochat/client/config"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// tlsConfig returns how the certificate of the server is checked, nil when
+// the server is reached without TLS
+func tlsConfig(cfg config.Config) (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.TLSInsecureSkipVerify}
+	if cfg.TLSCA != "" {
+		// for servers with a certificate not signed by the system CAs
+		pem, err := os.ReadFile(cfg.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to read CA bundle %s: no certificate found", cfg.TLSCA)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// serverURL returns the url of the path on the chat server, for the websocket
+// or for plain http requests
+func serverURL(cfg config.Config, ws bool, path string) url.URL {
+	scheme := "http"
+	if ws {
+		scheme = "ws"
+	}
+	if cfg.TLS {
+		scheme += "s"
+	}
+	return url.URL{Scheme: scheme, Host: fmt.Sprintf("%s:%s", cfg.Host, cfg.Port), Path: path}
+}
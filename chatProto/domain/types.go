@@ -1,24 +1,69 @@
 package domain
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"slices"
 	"time"
+)
+
+type MessageStatus int
 
-	"github.com/google/uuid"
+// status of a message sent by this client, as reported by the receipts
+const (
+	STATUS_PENDING MessageStatus = iota
+	STATUS_SENT
+	STATUS_DELIVERED
+	STATUS_READ
+	// refused by the server, see the CMD_ERROR
+	STATUS_FAILED
 )
 
 type Message struct {
-	Type      string
-	Sender    User
-	Reciever  User
-	Content   []byte
+	// generated by the client that sends a chat message, used by the receipts
+	Id       string
+	Type     string
+	Sender   User
+	Reciever User
+	// id of the room for room commands and messages
+	Room    string
+	Content []byte
+	// set by the server when it accepts a chat message. Seq counts the
+	// messages of the conversation starting at 1, without holes
 	Timestamp time.Time
+	Seq       uint64
+	// chosen by the client for every message it writes and copied by the
+	// server to the response, or to the CMD_ERROR when the request failed
+	RequestId string
+	// only tracked locally by the sender
+	Status MessageStatus `json:"-"`
 }
 
 type User struct {
 	Id     string
 	Name   string
 	Avatar []byte
+	// the avatar is only sent in the hello, everywhere else this hash is used
+	// to fetch it from the server
+	AvatarHash string
+	PublicKey  []byte
+	// one of the PRESENCE_ constants, "" is online
+	Presence   string
+	StatusText string
+}
+
+type Room struct {
+	Id      string
+	Name    string
+	Owner   string
+	Members []string
+}
+
+// Typing tells that a user is writing in a conversation until it expires
+type Typing struct {
+	User    *User
+	Expires time.Time
 }
 
 type Notification struct {
@@ -31,14 +76,91 @@ type ChatHistory struct {
 	Unread   bool
 }
 
-func CreateUser(nickName string, avatar []byte) *User {
-	return &User{Id: uuid.New().String(), Name: nickName, Avatar: avatar}
+// HistoryQuery is the content of a CMD_GET_HISTORY message. The conversation
+// is the one of the Room of the message if set, otherwise the one between
+// the Sender and the Reciever
+type HistoryQuery struct {
+	// number of most recent messages to skip
+	Offset int
+	Limit  int
+	// when set, asks for the messages that follow this sequence number
+	// instead, oldest first. Used to fill gaps
+	After uint64
+}
+
+// HistoryPage is the content of a CMD_GET_HISTORY_RESPONSE message
+type HistoryPage struct {
+	Offset   int
+	After    uint64
+	Messages []*Message
+	More     bool
+}
+
+// Hello is the content of the CMD_HELLO that opens a session, sent by the
+// client with what it supports. The CMD_HELLO_OK of the server carries what
+// both sides support
+type Hello struct {
+	Version      int
+	Capabilities []string
+	// codecs accepted by the client, the server answers with the one it
+	// picked. JSON when empty
+	Codecs []string
+}
+
+// Profile is what a user can change about itself during a session, sent in
+// a CMD_UPDATE_PROFILE
+type Profile struct {
+	Name   string
+	Avatar []byte
+}
+
+// Presence is the content of a CMD_SET_PRESENCE
+type Presence struct {
+	State string
+	Text  string
+}
+
+// ErrorInfo is the content of a CMD_ERROR. The RequestId of the message is
+// the one of the request that failed
+type ErrorInfo struct {
+	Code   string
+	Reason string
+	// type of the request that failed
+	Command string
+}
+
+// Rejection is the content of a CMD_CONN_REJECTED
+type Rejection struct {
+	Code   string
+	Reason string
+}
+
+// Ref returns the user as messages reference it, without the avatar and the key
+func (u *User) Ref() User {
+	return User{Id: u.Id, Name: u.Name, AvatarHash: u.AvatarHash, Presence: u.Presence, StatusText: u.StatusText}
+}
+
+// AvatarHash returns the hash addressing the avatar on the server, "" without one
+func AvatarHash(avatar []byte) string {
+	if len(avatar) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(avatar)
+	return hex.EncodeToString(sum[:])
 }
 
 func (u *User) String() string {
 	return fmt.Sprintf("%s:%s", u.Id, u.Name)
 }
 
+func (r *Room) HasMember(id string) bool {
+	return slices.Contains(r.Members, id)
+}
+
+func (r *Room) String() string {
+	return fmt.Sprintf("%s:%s", r.Id, r.Name)
+}
+
 func (n *Notification) String() string {
 	return fmt.Sprintf("%s: %s", n.User.Name, n.Message)
 }
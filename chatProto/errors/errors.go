@@ -8,6 +8,14 @@ func (err ChatServerConnectionError) Error() string {
 	return fmt.Sprintf("Connection to Chat Server rejected. Reason: %s\n", string(err))
 }
 
+// NickNameError is a connection rejected because of the nickname, another
+// one has to be picked
+type NickNameError string
+
+func (err NickNameError) Error() string {
+	return fmt.Sprintf("Nickname refused by Chat Server. Reason: %s\n", string(err))
+}
+
 type WSFrameBuildError string
 
 func (err WSFrameBuildError) Error() string {
@@ -19,3 +27,19 @@ type WSFrameReadError string
 func (err WSFrameReadError) Error() string {
 	return fmt.Sprintf("Error reading websocket frame. Reason: %s\n", string(err))
 }
+
+type ProtocolVersionError string
+
+func (err ProtocolVersionError) Error() string {
+	return fmt.Sprintf("Protocol version not supported by Chat Server. Reason: %s\n", string(err))
+}
+
+// ChatServerRequestError is a request refused by the Chat Server with a CMD_ERROR
+type ChatServerRequestError struct {
+	Code   string
+	Reason string
+}
+
+func (err ChatServerRequestError) Error() string {
+	return fmt.Sprintf("Request refused by Chat Server. Reason: %s\n", err.Reason)
+}
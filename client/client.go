@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"example/zerochat/chatProto/domain"
+	chatErrors "example/zerochat/chatProto/errors"
 	"example/zerochat/client/config"
 	"example/zerochat/client/ui"
 	"fmt"
@@ -9,6 +12,8 @@ import (
 	"image/color"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"gioui.org/app"
 	"gioui.org/layout"
@@ -24,6 +29,9 @@ var (
 	focused bool
 )
 
+// time the server has to accept a profile edited during the session
+const PROFILE_UPDATE_TIMEOUT = 10 * time.Second
+
 func repaint() {
 	if window != nil {
 		window.Invalidate()
@@ -32,33 +40,62 @@ func repaint() {
 
 func run(window *app.Window, cfg config.Config, client *domain.Client) error {
 	theme := material.NewTheme()
-	usrChangedChan := make(chan string)
+	// the lists write to it while the frame is drawn and the chat panel reads
+	// it later in the same frame, it must not block them
+	usrChangedChan := make(chan string, 16)
 	var usersPanel *ui.UsersPanel
 	var chatPanel *ui.ChatPanel
 	var profilePanel *ui.ProfilePanel
+	// the profile editor while it is open and the answers of the server to it
+	var editor *ui.ProfilePanel
+	profileUpdates := make(chan error, 1)
 
 	img, err := ui.CreateDefaultImage()
 	if err != nil {
 		log.Printf("failed to generate default avatar %s\n", err)
 	}
 
+	// reuse the identity of the previous sessions so the server recognises us
+	identity, err := domain.LoadIdentity(config.PROFILE_FILE)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to load profile, creating a new identity: %s\n", err)
+		}
+		identity, err = domain.CreateIdentity()
+		if err != nil {
+			return fmt.Errorf("failed to create identity: %s", err)
+		}
+	} else if identity.Avatar != nil {
+		img = identity.Avatar
+	}
+
 	profilePanel = &ui.ProfilePanel{
 		Avatar: img,
 		OnConfirm: func(nickName string) {
-			client = domain.InitClientConnection(nickName, img, cfg, func(err error) {
-				if err != nil {
-					usersPanel.ConnError = true
-				}
+			identity.Name = nickName
+			identity.Avatar = img
+			if err := identity.Save(config.PROFILE_FILE); err != nil {
+				log.Printf("failed to save profile %s\n", err)
+			}
+			client = domain.InitClientConnection(identity, cfg, func(domain.Event) {
 				repaint()
 			})
+			client.Focus(focused)
 			usersPanel = ui.CreateUsersPanel(client, usrChangedChan)
 			chatPanel = ui.CreateChatPanel(client, usrChangedChan)
+			usersPanel.OnEditProfile = func() {
+				editor = createProfileEditor(client, profileUpdates)
+				editor.OnCancel = func() {
+					editor = nil
+				}
+			}
 		},
 		OnImageLoad: func(image []byte) {
 			img = image
 			repaint()
 		},
 	}
+	profilePanel.SetNickName(identity.Name)
 
 	n, err := notify.NewNotifier()
 	if err != nil {
@@ -76,31 +113,86 @@ func run(window *app.Window, cfg config.Config, client *domain.Client) error {
 			// This graphics context is used for managing the rendering state.
 			gtx := app.NewContext(&ops, e)
 
+			// the server refused the nickname, let the user pick another one
+			var refused chatErrors.NickNameError
+			if client != nil && errors.As(client.Connection().Err, &refused) {
+				profilePanel.SetError(string(refused))
+				client = nil
+			}
+
+			select {
+			case err := <-profileUpdates:
+				// the editor may have been cancelled meanwhile
+				if editor != nil && err != nil {
+					editor.SetError(profileError(err))
+				} else {
+					editor = nil
+				}
+			default:
+			}
+
 			if client == nil {
 				profilePanel.Layout(gtx, theme)
+			} else if editor != nil {
+				editor.Layout(gtx, theme)
 			} else {
 				chatScreen(gtx, theme, usersPanel, chatPanel)
 			}
 
 			if !focused && client != nil {
-				for _, notif := range client.Notifications {
+				for _, notif := range client.TakeNotifications() {
 					if ongoingSupported {
 						go notifier.(notify.OngoingNotifier).CreateOngoingNotification("Zerochat", notif.String())
 					} else {
 						go notifier.CreateNotification("Zerochat", notif.String())
 					}
 				}
-				client.Notifications = client.Notifications[0:0]
 			}
 
 			// Pass the drawing operations to the GPU.
 			e.Frame(gtx.Ops)
 		case app.ConfigEvent:
+			if e.Config.Focused != focused && client != nil {
+				client.Focus(e.Config.Focused)
+			}
 			focused = e.Config.Focused
 		}
 	}
 }
 
+// createProfileEditor opens the profile panel to change our profile during
+// the session. The answer of the server is sent to updates
+func createProfileEditor(client *domain.Client, updates chan<- error) *ui.ProfilePanel {
+	me := client.User()
+	editor := &ui.ProfilePanel{Avatar: client.Avatar(me)}
+	editor.SetNickName(me.Name)
+	editor.OnImageLoad = func([]byte) {
+		repaint()
+	}
+	editor.OnConfirm = func(nickName string) {
+		avatar := editor.Avatar
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), PROFILE_UPDATE_TIMEOUT)
+			defer cancel()
+			updates <- client.UpdateProfile(ctx, nickName, avatar)
+			repaint()
+		}()
+	}
+	return editor
+}
+
+// profileError describes why the profile was not updated
+func profileError(err error) string {
+	var refused chatErrors.ChatServerRequestError
+	if errors.As(err, &refused) {
+		return refused.Reason
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "No answer from the server"
+	}
+	return strings.TrimSpace(err.Error())
+}
+
 func chatScreen(
 	gtx layout.Context,
 	theme *material.Theme,
@@ -6,32 +6,169 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
+	CONFIG_FILE = "zerochat.cfg"
+	// identity of the client, kept next to the config file
+	PROFILE_FILE = "zerochat.profile"
+
 	DEFAULT_CLIENT_HOST = "localhost"
 	DEFAULT_CLIENT_PORT = "8080"
 	DEFAULT_SERVER_HOST = "0.0.0.0"
 	DEFAULT_SERVER_PORT = "8080"
+
+	// message store used by the server: "file" or "memory"
+	DEFAULT_SERVER_STORE      = "file"
+	DEFAULT_SERVER_STORE_PATH = "zerochat_messages.log"
+	DEFAULT_SERVER_USERS_PATH = "zerochat_users.json"
+	DEFAULT_SERVER_ROOMS_PATH = "zerochat_rooms.json"
+
+	// messages kept for each offline user and for how long
+	DEFAULT_SERVER_OFFLINE_QUEUE_SIZE = 100
+	DEFAULT_SERVER_OFFLINE_QUEUE_TTL  = 7 * 24 * time.Hour
+
+	// messages waiting to be written to each connected client and what to do
+	// when a client can't keep up: "drop-oldest", "disconnect" or "spill" to
+	// a queue of SpillQueueSize messages
+	DEFAULT_SERVER_SEND_QUEUE_SIZE      = 64
+	DEFAULT_SERVER_SLOW_CONSUMER_POLICY = "drop-oldest"
+	DEFAULT_SERVER_SPILL_QUEUE_SIZE     = 1000
+
+	// both ends ping every PingInterval and drop the connection when no pong
+	// arrives within PongTimeout. Keep it below the proxy read timeout of nginx
+	DEFAULT_PING_INTERVAL = 25 * time.Second
+	DEFAULT_PONG_TIMEOUT  = 50 * time.Second
+
+	// encoding of the frames asked by the client: "binary", falling back to
+	// JSON on servers that don't know it, or "json" to make them readable
+	DEFAULT_CLIENT_CODEC = "binary"
+
+	// connections accepted by the server in total and from a single address,
+	// 0 for no limit, and the size in bytes of the biggest frame read
+	DEFAULT_SERVER_MAX_CONNECTIONS        = 1000
+	DEFAULT_SERVER_MAX_CONNECTIONS_PER_IP = 10
+	DEFAULT_SERVER_MAX_FRAME_SIZE         = 1 << 20
+
+	// addresses of the proxies in front of the server, like the nginx of
+	// nginx-websocket.conf. Their connections are counted against the address
+	// they put in X-Forwarded-For
+	DEFAULT_SERVER_TRUSTED_PROXIES = "127.0.0.1,::1"
+
+	// chat messages a user may send per second after a burst, and frames of any
+	// kind per second after a burst on each connection, 0 for no limit. After
+	// RateLimitStrikes refusals within a minute the user is muted for
+	// MuteDuration, or disconnected with the "disconnect" penalty
+	DEFAULT_SERVER_MESSAGE_RATE       = 5
+	DEFAULT_SERVER_MESSAGE_BURST      = 20
+	DEFAULT_SERVER_FRAME_RATE         = 50
+	DEFAULT_SERVER_FRAME_BURST        = 200
+	DEFAULT_SERVER_RATE_LIMIT_STRIKES = 10
+	DEFAULT_SERVER_RATE_LIMIT_PENALTY = "mute"
+	DEFAULT_SERVER_MUTE_DURATION      = time.Minute
+
+	// permessage-deflate on the websocket when both ends enable it, the level
+	// goes from 1 (fastest) to 9 (smallest)
+	DEFAULT_COMPRESSION       = true
+	DEFAULT_COMPRESSION_LEVEL = 1
+
+	// online users turn away after this long without looking at the chat
+	DEFAULT_CLIENT_AWAY_AFTER = 5 * time.Minute
+
+	// directory where the avatars fetched from the server are kept
+	DEFAULT_CLIENT_AVATAR_CACHE_PATH = "zerochat_avatars"
 )
 
 type Config struct {
-	Host string
-	Port string
+	Host               string
+	Port               string
+	Store              string
+	StorePath          string
+	UsersPath          string
+	RoomsPath          string
+	OfflineQueueSize   int
+	OfflineQueueTTL    time.Duration
+	SendQueueSize      int
+	SlowConsumerPolicy string
+	SpillQueueSize     int
+	PingInterval       time.Duration
+	PongTimeout        time.Duration
+	Codec              string
+	AvatarCachePath    string
+	AwayAfter          time.Duration
+	Compression        bool
+	CompressionLevel   int
+
+	// the server serves wss when given a certificate and its key. Clients with
+	// TLS set check it against the system CAs, or the PEM bundle in TLSCA, and
+	// TLSInsecureSkipVerify accepts any certificate, only use it for testing
+	TLSCert               string
+	TLSKey                string
+	TLS                   bool
+	TLSCA                 string
+	TLSInsecureSkipVerify bool
+
+	// comma separated origins of the web pages allowed to connect, "*" for
+	// any. Without them only pages served by the chat server itself can
+	AllowedOrigins      string
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	TrustedProxies      string
+	MaxFrameSize        int
+	MessageRate         int
+	MessageBurst        int
+	FrameRate           int
+	FrameBurst          int
+	RateLimitStrikes    int
+	RateLimitPenalty    string
+	MuteDuration        time.Duration
 }
 
 func DefaultClientConfig() Config {
 	return Config{
-		Host: DEFAULT_CLIENT_HOST,
-		Port: DEFAULT_CLIENT_PORT,
+		Host:             DEFAULT_CLIENT_HOST,
+		Port:             DEFAULT_CLIENT_PORT,
+		PingInterval:     DEFAULT_PING_INTERVAL,
+		PongTimeout:      DEFAULT_PONG_TIMEOUT,
+		Codec:            DEFAULT_CLIENT_CODEC,
+		AvatarCachePath:  DEFAULT_CLIENT_AVATAR_CACHE_PATH,
+		AwayAfter:        DEFAULT_CLIENT_AWAY_AFTER,
+		Compression:      DEFAULT_COMPRESSION,
+		CompressionLevel: DEFAULT_COMPRESSION_LEVEL,
 	}
 }
 
 func DefaultServerConfig() Config {
 	return Config{
-		Host: DEFAULT_SERVER_HOST,
-		Port: DEFAULT_SERVER_PORT,
+		Host:                DEFAULT_SERVER_HOST,
+		Port:                DEFAULT_SERVER_PORT,
+		Store:               DEFAULT_SERVER_STORE,
+		StorePath:           DEFAULT_SERVER_STORE_PATH,
+		UsersPath:           DEFAULT_SERVER_USERS_PATH,
+		RoomsPath:           DEFAULT_SERVER_ROOMS_PATH,
+		OfflineQueueSize:    DEFAULT_SERVER_OFFLINE_QUEUE_SIZE,
+		OfflineQueueTTL:     DEFAULT_SERVER_OFFLINE_QUEUE_TTL,
+		SendQueueSize:       DEFAULT_SERVER_SEND_QUEUE_SIZE,
+		SlowConsumerPolicy:  DEFAULT_SERVER_SLOW_CONSUMER_POLICY,
+		SpillQueueSize:      DEFAULT_SERVER_SPILL_QUEUE_SIZE,
+		PingInterval:        DEFAULT_PING_INTERVAL,
+		PongTimeout:         DEFAULT_PONG_TIMEOUT,
+		Compression:         DEFAULT_COMPRESSION,
+		CompressionLevel:    DEFAULT_COMPRESSION_LEVEL,
+		MaxConnections:      DEFAULT_SERVER_MAX_CONNECTIONS,
+		MaxConnectionsPerIP: DEFAULT_SERVER_MAX_CONNECTIONS_PER_IP,
+		TrustedProxies:      DEFAULT_SERVER_TRUSTED_PROXIES,
+		MaxFrameSize:        DEFAULT_SERVER_MAX_FRAME_SIZE,
+		MessageRate:         DEFAULT_SERVER_MESSAGE_RATE,
+		MessageBurst:        DEFAULT_SERVER_MESSAGE_BURST,
+		FrameRate:           DEFAULT_SERVER_FRAME_RATE,
+		FrameBurst:          DEFAULT_SERVER_FRAME_BURST,
+		RateLimitStrikes:    DEFAULT_SERVER_RATE_LIMIT_STRIKES,
+		RateLimitPenalty:    DEFAULT_SERVER_RATE_LIMIT_PENALTY,
+		MuteDuration:        DEFAULT_SERVER_MUTE_DURATION,
 	}
 }
 
@@ -46,7 +183,11 @@ func WriteConfig(config Config, filename string) {
 	for i := 0; i < t.NumField(); i++ {
 		fieldName := t.Field(i).Name
 		fieldValue := v.Field(i)
-		file.WriteString(fmt.Sprintf("%s: %s\n", fieldName, fieldValue))
+		// settings that only make sense on the other side are left out
+		if fieldValue.IsZero() {
+			continue
+		}
+		file.WriteString(fmt.Sprintf("%s: %v\n", fieldName, fieldValue))
 	}
 }
 
@@ -59,10 +200,10 @@ func ReadServerConfig() Config {
 }
 
 func ReadConfig(defaultConfig Config) Config {
-	file, err := os.Open("zerochat.cfg")
+	file, err := os.Open(CONFIG_FILE)
 	if err != nil {
 		log.Println("Creating config file with default values")
-		WriteConfig(defaultConfig, "zerochat.cfg")
+		WriteConfig(defaultConfig, CONFIG_FILE)
 		return defaultConfig
 	}
 	defer file.Close()
@@ -71,7 +212,8 @@ func ReadConfig(defaultConfig Config) Config {
 
 	for i := 0; scanner.Scan(); i++ {
 		line := scanner.Text()
-		parts := strings.Split(line, ":")
+		// values may contain ':' themselves (paths on windows) so only split on the first one
+		parts := strings.SplitN(line, ":", 2)
 		if len(parts) != 2 {
 			log.Printf("Error: skipping config line %d with wrong format \"%s\"\n", i+1, line)
 			continue
@@ -79,18 +221,52 @@ func ReadConfig(defaultConfig Config) Config {
 		v := reflect.ValueOf(&defaultConfig).Elem()
 		search := strings.TrimSpace(parts[0])
 		field := v.FieldByName(search)
-		if field.IsValid() && field.CanSet() && field.Kind() == reflect.String {
-			field.SetString(strings.TrimSpace(parts[1]))
-		} else {
+		if !field.IsValid() || !field.CanSet() {
 			log.Printf("Error: skipping config line %d with key not recognized \"%s\"\n", i+1, line)
 			continue
 		}
+		if err := setField(field, strings.TrimSpace(parts[1])); err != nil {
+			log.Printf("Error: skipping config line %d with invalid value \"%s\": %s\n", i+1, line, err)
+			continue
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		log.Printf("err in scanner: %s\n", err)
 	}
 
+	if defaultConfig.PingInterval > 0 && defaultConfig.PongTimeout <= defaultConfig.PingInterval {
+		log.Printf("Warning: PongTimeout %s should be longer than PingInterval %s\n", defaultConfig.PongTimeout, defaultConfig.PingInterval)
+	}
+
 	log.Printf("Returning config: %#v\n", defaultConfig)
 	return defaultConfig
 }
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
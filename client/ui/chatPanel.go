@@ -1,15 +1,20 @@
 package ui
 
 import (
+	"errors"
 	"example/zerochat/chatProto"
 	"example/zerochat/chatProto/domain"
+	chatErrors "example/zerochat/chatProto/errors"
 	"fmt"
 	"image/color"
 	"log"
-	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"gioui.org/font"
 	"gioui.org/layout"
+	"gioui.org/op"
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
@@ -21,12 +26,28 @@ var (
 	red  = color.NRGBA{R: 0xC0, G: 0x20, B: 0x20, A: 0xFF}
 )
 
+// the commands typed in the input instead of a message, they act from any conversation
+var presenceCommands = map[string]string{
+	"/online":    chatProto.PRESENCE_ONLINE,
+	"/away":      chatProto.PRESENCE_AWAY,
+	"/busy":      chatProto.PRESENCE_BUSY,
+	"/invisible": chatProto.PRESENCE_INVISIBLE,
+}
+
+// how long a request refused by the server is shown under the title
+const ERROR_DISPLAY_TIME = 10 * time.Second
+
 type ChatPanel struct {
 	client            *domain.Client
 	selectedUser      *domain.User
+	selectedRoom      string // takes precedence over selectedUser when set
 	input             component.TextField
 	changeUserChannel <-chan string
 	list              widget.List
+	lastTyping        time.Time
+	// messages of the selected conversation, reloaded when dirty is set
+	messages []*domain.Message
+	dirty    atomic.Bool
 }
 
 func CreateChatPanel(
@@ -36,49 +57,69 @@ func CreateChatPanel(
 	chatPanel := &ChatPanel{
 		client:            client,
 		changeUserChannel: changeUserChannel,
-		selectedUser:      client.User,
+		selectedUser:      client.User(),
 	}
 
-	go func() {
-		for id := range chatPanel.changeUserChannel {
+	chatPanel.dirty.Store(true)
+	client.Subscribe(func(e domain.Event) {
+		switch e.Type {
+		case domain.EVENT_HISTORY, domain.EVENT_USERS, domain.EVENT_PROFILE:
+			chatPanel.dirty.Store(true)
+		}
+	})
+
+	return chatPanel
+}
+
+// selectConversation applies what was picked in the lists since the last
+// frame. It runs on the frame goroutine like everything reading the selection
+func (chat *ChatPanel) selectConversation() {
+	for {
+		select {
+		case id := <-chat.changeUserChannel:
 			log.Printf("got change selected user event %s\n", id)
-			res, ok := client.ActiveUsers[id]
-			if ok {
-				chatPanel.selectedUser = res
+			chat.selectedRoom = ""
+			if user, ok := chat.client.ActiveUser(id); ok {
+				chat.selectedUser = user
+			} else if _, ok := chat.client.Room(id); ok {
+				chat.selectedRoom = id
 			} else {
-				chatPanel.selectedUser = client.User
+				chat.selectedUser = chat.client.User()
 			}
+			chat.dirty.Store(true)
+		default:
+			return
 		}
-	}()
-
-	return chatPanel
+	}
 }
 
 func (chat *ChatPanel) getMessages() []*domain.Message {
+	if !chat.dirty.Swap(false) {
+		return chat.messages
+	}
+	// the selected user may have changed its profile
+	if user, ok := chat.client.ActiveUser(chat.selectedUser.Id); ok {
+		chat.selectedUser = user
+	} else if chat.selectedUser.Id == chat.client.User().Id {
+		chat.selectedUser = chat.client.User()
+	}
+	conversation := chat.selectedUser.Id
+	if chat.selectedRoom != "" {
+		conversation = chat.selectedRoom
+	}
+
 	var messages []*domain.Message
-	if chat.selectedUser.Id == chat.client.User.Id {
-		messages = chat.client.Draft
+	if conversation == chat.client.User().Id {
+		messages = chat.client.Drafts()
 	} else {
-		chatHistory, ok := chat.client.ChatHistory[chat.selectedUser.Id]
-		if !ok {
-			return []*domain.Message{}
-		}
+		chatHistory, _ := chat.client.History(conversation)
 		messages = chatHistory.Messages
-	}
-	slices.SortFunc(messages, func(a, b *domain.Message) int {
-		if a.Timestamp.Before(b.Timestamp) {
-			return -1
-		} else if a.Timestamp.After(b.Timestamp) {
-			return 1
+		if chatHistory.Unread {
+			chat.client.MarkRead(conversation)
 		}
-		return 1
-	})
-
-	//update chathistory unread to false
-	history := chat.client.ChatHistory[chat.selectedUser.Id]
-	history.Unread = false
-	chat.client.ChatHistory[chat.selectedUser.Id] = history
-
+	}
+	// already ordered by the client, by sequence number
+	chat.messages = messages
 	return messages
 }
 
@@ -88,6 +129,9 @@ func (chat *ChatPanel) processEvents(gtx layout.Context) {
 		if !ok {
 			break
 		}
+		if _, ok := e.(widget.ChangeEvent); ok {
+			chat.notifyTyping()
+		}
 		if e, ok := e.(widget.SubmitEvent); ok {
 			t := e.Text
 
@@ -96,40 +140,192 @@ func (chat *ChatPanel) processEvents(gtx layout.Context) {
 			if t == "" {
 				return
 			}
-			if chat.selectedUser.Id != chat.client.User.Id {
+			if chat.command(t) {
+				continue
+			}
+			if chat.selectedRoom != "" {
+				chat.sendToRoom(t)
+			} else if chat.selectedUser.Id != chat.client.User().Id {
 				msg := &domain.Message{
 					Type:     chatProto.CMD_SEND_MSG_SINGLE,
-					Sender:   *chat.client.User,
+					Sender:   *chat.client.User(),
 					Reciever: *chat.selectedUser,
 					Content:  []byte(t),
 				}
-				chat.client.WriteChan <- msg
-				history := chat.client.ChatHistory[chat.selectedUser.Id]
-				history.Messages = append(history.Messages, msg)
-				chat.client.ChatHistory[chat.selectedUser.Id] = history
+				chat.client.Send(msg)
 			} else {
-				msg := &domain.Message{
-					Type:     chatProto.CMD_SEND_MSG_SINGLE,
-					Sender:   *chat.client.User,
-					Reciever: *chat.client.User,
-					Content:  []byte(t),
-				}
-				chat.client.Draft = append(chat.client.Draft, msg)
+				chat.client.SaveDraft(t)
 			}
 		}
 	}
 }
 
+// command runs the slash commands, it reports false for a plain message
+func (chat *ChatPanel) command(t string) bool {
+	fields := strings.Fields(t)
+	if len(fields) == 0 {
+		return false
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(t), fields[0]))
+	switch {
+	// "/nick <nickname>" renames us
+	case fields[0] == "/nick" && len(fields) == 2:
+		chat.client.ChangeNickName(fields[1])
+	// "/away [status]", "/busy [status]", "/online [status]" and "/invisible"
+	case presenceCommands[fields[0]] != "":
+		if fields[0] == "/invisible" {
+			text = ""
+		}
+		chat.client.SetPresence(presenceCommands[fields[0]], text)
+	// "/status <status>" keeps the state and changes the text
+	case fields[0] == "/status":
+		chat.client.SetPresence(chat.client.Presence().State, text)
+	default:
+		return false
+	}
+	return true
+}
+
+// notifyTyping tells the conversation that we are typing, at most once every TYPING_INTERVAL
+func (chat *ChatPanel) notifyTyping() {
+	if chat.isDrafts() || chat.input.Text() == "" || time.Since(chat.lastTyping) < chatProto.TYPING_INTERVAL {
+		return
+	}
+	chat.lastTyping = time.Now()
+	if chat.selectedRoom != "" {
+		chat.client.SendTyping(nil, chat.selectedRoom)
+	} else {
+		chat.client.SendTyping(chat.selectedUser, "")
+	}
+}
+
+// typingLine describes who is typing in the selected conversation
+func (chat *ChatPanel) typingLine(gtx layout.Context) string {
+	conversation := chat.selectedUser.Id
+	if chat.selectedRoom != "" {
+		conversation = chat.selectedRoom
+	}
+	names, expires := chat.client.TypingIn(conversation)
+	if len(names) == 0 {
+		return ""
+	}
+	// redraw when the indicator expires even if nothing else happens
+	gtx.Execute(op.InvalidateCmd{At: expires})
+	if len(names) == 1 {
+		return fmt.Sprintf("%s is typing…", names[0])
+	}
+	return fmt.Sprintf("%s are typing…", strings.Join(names, ", "))
+}
+
+// errorLine describes the last request refused by the server, for a while
+func (chat *ChatPanel) errorLine(gtx layout.Context) string {
+	err, at := chat.client.LastError()
+	if err == nil || gtx.Now.Sub(at) > ERROR_DISPLAY_TIME {
+		return ""
+	}
+	gtx.Execute(op.InvalidateCmd{At: at.Add(ERROR_DISPLAY_TIME)})
+	var refused chatErrors.ChatServerRequestError
+	if errors.As(err, &refused) {
+		return refused.Reason
+	}
+	return strings.TrimSpace(err.Error())
+}
+
+// sendToRoom sends the text to the selected room. Lines starting with
+// "/invite <nickname>" or "/leave" manage the membership instead
+func (chat *ChatPanel) sendToRoom(text string) {
+	fields := strings.Fields(text)
+	switch {
+	case len(fields) == 2 && fields[0] == "/invite":
+		if user, ok := chat.client.FindUser(fields[1]); ok {
+			chat.client.InviteToRoom(chat.selectedRoom, user)
+			return
+		}
+		log.Printf("can't invite %s, no such user online\n", fields[1])
+	case len(fields) == 1 && fields[0] == "/leave":
+		chat.client.LeaveRoom(chat.selectedRoom)
+		chat.selectedRoom = ""
+		chat.selectedUser = chat.client.User()
+		chat.dirty.Store(true)
+	default:
+		msg := &domain.Message{
+			Type:    chatProto.CMD_SEND_MSG_ROOM,
+			Sender:  *chat.client.User(),
+			Room:    chat.selectedRoom,
+			Content: []byte(text),
+		}
+		chat.client.Send(msg)
+	}
+}
+
+// statusTicks shows how far a message we sent got
+func statusTicks(theme *material.Theme, message *domain.Message) material.LabelStyle {
+	ticks := map[domain.MessageStatus]string{
+		domain.STATUS_PENDING:   "...",
+		domain.STATUS_SENT:      "v",
+		domain.STATUS_DELIVERED: "vv",
+		domain.STATUS_READ:      "vv",
+		domain.STATUS_FAILED:    "!",
+	}
+	lb := material.Label(theme, unit.Sp(14), ticks[message.Status])
+	lb.Color = grey
+	if message.Status == domain.STATUS_READ {
+		lb.Color = blue
+	} else if message.Status == domain.STATUS_FAILED {
+		lb.Color = red
+	}
+	lb.Font.Typeface = "Consolas"
+	return lb
+}
+
+// isDrafts reports if the selected conversation is the one with ourselves
+func (chat *ChatPanel) isDrafts() bool {
+	return chat.selectedRoom == "" && chat.selectedUser.Id == chat.client.User().Id
+}
+
+// title returns the name of the selected conversation
+func (chat *ChatPanel) title() string {
+	if room, ok := chat.client.Room(chat.selectedRoom); ok {
+		return fmt.Sprintf("%s (%d members)", room.Name, len(room.Members))
+	}
+	return chat.selectedUser.Name
+}
+
 func (chat *ChatPanel) Layout(gtx layout.Context, theme *material.Theme) layout.Dimensions {
+	chat.selectConversation()
 	messages := chat.getMessages()
 	chat.processEvents(gtx)
 	return layout.Flex{Axis: layout.Vertical}.Layout(
 		gtx,
 		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
 			return layout.Inset{Bottom: unit.Dp(20)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-				lb := material.Label(theme, unit.Sp(18), chat.selectedUser.Name)
-				lb.Font.Weight = font.Bold
-				return lb.Layout(gtx)
+				return layout.Flex{Axis: layout.Vertical}.Layout(
+					gtx,
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						lb := material.Label(theme, unit.Sp(18), chat.title())
+						lb.Font.Weight = font.Bold
+						return lb.Layout(gtx)
+					}),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						typing := chat.typingLine(gtx)
+						if typing == "" {
+							return layout.Dimensions{}
+						}
+						lb := material.Label(theme, unit.Sp(12), typing)
+						lb.Color = grey
+						lb.Font.Style = font.Italic
+						return lb.Layout(gtx)
+					}),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						failure := chat.errorLine(gtx)
+						if failure == "" {
+							return layout.Dimensions{}
+						}
+						lb := material.Label(theme, unit.Sp(12), failure)
+						lb.Color = red
+						return lb.Layout(gtx)
+					}),
+				)
 			})
 		}),
 		layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
@@ -137,8 +333,15 @@ func (chat *ChatPanel) Layout(gtx layout.Context, theme *material.Theme) layout.
 			chat.list.ScrollToEnd = true
 			return chat.list.Layout(gtx, len(messages), func(gtx layout.Context, index int) layout.Dimensions {
 				max := len(chat.selectedUser.Name)
-				if len(chat.selectedUser.Name) < len(chat.client.User.Name) {
-					max = len(chat.client.User.Name)
+				if len(chat.selectedUser.Name) < len(chat.client.User().Name) {
+					max = len(chat.client.User().Name)
+				}
+				if chat.selectedRoom != "" {
+					for _, m := range messages {
+						if len(m.Sender.Name) > max {
+							max = len(m.Sender.Name)
+						}
+					}
 				}
 				max += 3
 
@@ -150,13 +353,23 @@ func (chat *ChatPanel) Layout(gtx layout.Context, theme *material.Theme) layout.
 					messages[index].Content,
 				)
 				lb := material.Label(theme, unit.Sp(16), display)
-				if messages[index].Sender.Id == chat.client.User.Id {
+				if messages[index].Sender.Id == chat.client.User().Id {
 					lb.Color = grey
 				} else {
 					lb.Color = red
 				}
 				lb.Font.Typeface = "Consolas"
-				return lb.Layout(gtx)
+				// drafts and messages from others have no receipts
+				if messages[index].Sender.Id != chat.client.User().Id || chat.isDrafts() {
+					return lb.Layout(gtx)
+				}
+				return layout.Flex{Alignment: layout.Baseline}.Layout(
+					gtx,
+					layout.Flexed(1, lb.Layout),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						return statusTicks(theme, messages[index]).Layout(gtx)
+					}),
+				)
 			})
 		}),
 		layout.Rigid(layout.Spacer{Height: unit.Dp(10)}.Layout),
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"embed"
+	"example/zerochat/chatProto"
 	"image"
 	"image/jpeg"
 	"log"
@@ -38,6 +39,9 @@ type ProfilePanel struct {
 	Avatar      []byte
 	OnConfirm   func(string)
 	OnImageLoad func([]byte)
+	// shows a Cancel button when set, for editing the profile during a session
+	OnCancel     func()
+	cancelButton widget.Clickable
 }
 
 func CreateDefaultImage() ([]byte, error) {
@@ -62,17 +66,32 @@ func CreateDefaultImage() ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// SetNickName prefills the nickname input, used for returning users
+func (profile *ProfilePanel) SetNickName(nickName string) {
+	profile.input.SetText(nickName)
+}
+
+// SetError shows why the nickname can't be used, like when the server refused it
+func (profile *ProfilePanel) SetError(text string) {
+	profile.input.SetError(text)
+}
+
 func (profile *ProfilePanel) processEvents(gtx layout.Context) {
 	if profile.imgChan == nil {
 		profile.imgChan = make(chan imageResult)
 	}
 	if profile.button.Clicked(gtx) && profile.OnConfirm != nil {
+		profile.input.ClearError()
 		if profile.input.Text() != "" {
 			profile.OnConfirm(profile.input.Text())
 		} else {
 			profile.input.SetError("Empty nickname")
 		}
 	}
+	if profile.cancelButton.Clicked(gtx) && profile.OnCancel != nil {
+		profile.input.ClearError()
+		profile.OnCancel()
+	}
 	if profile.photobutton.Clicked(gtx) {
 		go func() {
 			file, err := profile.expl.ChooseFile("png", "jpeg", "jpg")
@@ -168,8 +187,8 @@ func (profile *ProfilePanel) Layout(gtx layout.Context, theme *material.Theme) l
 				}),
 				layout.Rigid(layout.Spacer{Width: unit.Dp(20)}.Layout),
 				layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
-					profile.input.CharLimit = 20
-					profile.input.MaxLen = 20
+					profile.input.CharLimit = chatProto.MAX_NICK_LENGTH
+					profile.input.MaxLen = chatProto.MAX_NICK_LENGTH
 					profile.input.Filter = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_"
 					return profile.input.Layout(gtx, theme, "Enter a nickname")
 				}),
@@ -179,6 +198,14 @@ func (profile *ProfilePanel) Layout(gtx layout.Context, theme *material.Theme) l
 						return material.Button(theme, &profile.button, "Confirm").Layout(gtx)
 					})
 				}),
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					if profile.OnCancel == nil {
+						return layout.Dimensions{}
+					}
+					return layout.Inset{Top: unit.Dp(10), Left: unit.Dp(10)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+						return material.Button(theme, &profile.cancelButton, "Cancel").Layout(gtx)
+					})
+				}),
 			)
 		}),
 	)
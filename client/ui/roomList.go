@@ -0,0 +1,120 @@
+package ui
+
+import (
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"gioui.org/x/component"
+)
+
+type RoomList struct {
+	client            *domain.Client
+	list              layout.List
+	roomCards         []*UserCard
+	changeUserChannel chan<- string
+	selected          *string
+	input             component.TextField
+	// set when the rooms or their conversations changed
+	dirty atomic.Bool
+}
+
+func (list *RoomList) processEvents(gtx layout.Context) {
+	for i, card := range list.roomCards {
+		if card.btn.Clicked(gtx) {
+			log.Printf("click on room %d\n", i)
+			if room, ok := list.client.Room(card.user.Id); ok && !room.HasMember(list.client.User().Id) {
+				list.client.JoinRoom(room.Id)
+			}
+			list.changeUserChannel <- card.user.Id
+			*list.selected = card.user.Id
+		}
+	}
+
+	for {
+		e, ok := list.input.Editor.Update(gtx)
+		if !ok {
+			break
+		}
+		if e, ok := e.(widget.SubmitEvent); ok {
+			list.input.SetText("")
+			if name := strings.TrimSpace(e.Text); name != "" {
+				list.client.CreateRoom(name)
+			}
+		}
+	}
+}
+
+func (list *RoomList) updateRoomCards() {
+	rooms := list.client.Rooms()
+	slices.SortFunc(rooms, func(a, b *domain.Room) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+
+	roomsLen := len(rooms)
+	currentCardsLen := len(list.roomCards)
+
+	// increase the capacity in case the number of rooms grows
+	if roomsLen > currentCardsLen {
+		buf := make([]*UserCard, roomsLen-currentCardsLen)
+		list.roomCards = append(list.roomCards, buf...)
+	}
+
+	// rooms are shown with the same cards as users, without an avatar
+	for i, room := range rooms {
+		user := &domain.User{Id: room.Id, Name: room.Name}
+		var message string
+		var unread bool
+		if room.HasMember(list.client.User().Id) {
+			message = fmt.Sprintf("%d members", len(room.Members))
+			if history, ok := list.client.History(room.Id); ok {
+				if msgs := filterMessages(history.Messages); len(msgs) > 0 {
+					message = lastMessage(msgs)
+				}
+				unread = history.Unread
+			}
+		} else {
+			message = "Click to join"
+		}
+		if list.roomCards[i] == nil {
+			list.roomCards[i] = &UserCard{room: true}
+		}
+		list.roomCards[i].user = user
+		list.roomCards[i].avatar = nil
+		list.roomCards[i].message = message
+		list.roomCards[i].unread = unread
+	}
+
+	list.roomCards = list.roomCards[:len(rooms)]
+}
+
+func (list *RoomList) Layout(gtx layout.Context, theme *material.Theme) layout.Dimensions {
+	if list.dirty.Swap(false) {
+		list.updateRoomCards()
+	}
+	list.processEvents(gtx)
+	for _, card := range list.roomCards {
+		card.selected = card.user.Id == *list.selected
+	}
+	return layout.Flex{Axis: layout.Vertical}.Layout(
+		gtx,
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			gtx.Constraints.Max.X = 300
+			list.input.Submit = true
+			list.input.SingleLine = true
+			list.input.MaxLen = 30
+			return list.input.Layout(gtx, theme, "New room")
+		}),
+		layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+			return list.list.Layout(gtx, len(list.roomCards), func(gtx layout.Context, index int) layout.Dimensions {
+				return list.roomCards[index].Layout(gtx, theme)
+			})
+		}),
+	)
+}
@@ -2,9 +2,11 @@ package ui
 
 import (
 	"bytes"
+	"example/zerochat/chatProto"
 	"example/zerochat/chatProto/domain"
 	"fmt"
 	"image"
+	"image/color"
 	_ "image/jpeg"
 
 	"gioui.org/font"
@@ -17,12 +19,21 @@ import (
 	"golang.org/x/image/draw"
 )
 
+var (
+	green     = color.NRGBA{R: 0x20, G: 0xA0, B: 0x40, A: 0xFF}
+	amber     = color.NRGBA{R: 0xE0, G: 0xA0, B: 0x20, A: 0xFF}
+	lightGrey = color.NRGBA{R: 0x90, G: 0x90, B: 0x90, A: 0xFF}
+)
+
 type UserCard struct {
 	user     *domain.User
+	avatar   []byte
 	message  string
 	btn      widget.Clickable
 	unread   bool
 	selected bool
+	// rooms are drawn as cards too, without a presence
+	room bool
 }
 
 func (c *UserCard) String() string {
@@ -40,25 +51,11 @@ func (c *UserCard) Layout(gtx layout.Context, theme *material.Theme) layout.Dime
 					gtx,
 					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
 						dim := layout.UniformInset(unit.Dp(5)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-							dim := gtx.Constraints.Max.Y
-							gtx.Constraints.Max = image.Point{X: dim, Y: dim}
-							if c.user.Avatar != nil {
-								decoded, _, err := image.Decode(bytes.NewReader(c.user.Avatar))
-								if err != nil {
-									circle := clip.Ellipse{Max: image.Pt(dim, dim)}.Op(gtx.Ops)
-									paint.FillShape(gtx.Ops, blue, circle)
-									return layout.Dimensions{Size: image.Pt(dim, dim)}
-								}
-								img := image.NewRGBA(image.Rectangle{Max: image.Point{X: dim, Y: dim}})
-								draw.CatmullRom.Scale(img, img.Bounds(), decoded, decoded.Bounds(), draw.Src, nil)
-								imgWidget := widget.Image{Src: paint.NewImageOp(img)}
-								imgWidget.Scale = float32(dim) / float32(gtx.Dp(unit.Dp(float32(dim))))
-								return imgWidget.Layout(gtx)
-							} else {
-								circle := clip.Ellipse{Max: image.Pt(dim, dim)}.Op(gtx.Ops)
-								paint.FillShape(gtx.Ops, blue, circle)
-								return layout.Dimensions{Size: image.Pt(dim, dim)}
-							}
+							return layout.Stack{Alignment: layout.SE}.Layout(
+								gtx,
+								layout.Stacked(c.layoutAvatar),
+								layout.Stacked(c.layoutBadge),
+							)
 						})
 						return dim
 					}),
@@ -67,15 +64,29 @@ func (c *UserCard) Layout(gtx layout.Context, theme *material.Theme) layout.Dime
 							gtx,
 							layout.Flexed(0.5, func(gtx layout.Context) layout.Dimensions {
 								size := gtx.Constraints.Max
-								label := material.Label(theme, unit.Sp(16), c.user.Name)
-								if c.unread {
-									label.Color = red
-								}
-								if c.selected {
-									label.Font.Weight = font.Bold
-								}
-								label.MaxLines = 1
-								label.Layout(gtx)
+								layout.Flex{Alignment: layout.Baseline}.Layout(
+									gtx,
+									layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+										label := material.Label(theme, unit.Sp(16), c.user.Name)
+										if c.unread {
+											label.Color = red
+										}
+										if c.selected {
+											label.Font.Weight = font.Bold
+										}
+										label.MaxLines = 1
+										return label.Layout(gtx)
+									}),
+									layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+										if c.user.StatusText == "" {
+											return layout.Dimensions{}
+										}
+										label := material.Label(theme, unit.Sp(12), " "+c.user.StatusText)
+										label.Color = lightGrey
+										label.MaxLines = 1
+										return label.Layout(gtx)
+									}),
+								)
 								return layout.Dimensions{Size: size}
 							}),
 							layout.Flexed(0.5, func(gtx layout.Context) layout.Dimensions {
@@ -105,3 +116,47 @@ func (c *UserCard) Layout(gtx layout.Context, theme *material.Theme) layout.Dime
 	)
 
 }
+
+func (c *UserCard) layoutAvatar(gtx layout.Context) layout.Dimensions {
+	dim := gtx.Constraints.Max.Y
+	gtx.Constraints.Max = image.Point{X: dim, Y: dim}
+	if c.avatar != nil {
+		decoded, _, err := image.Decode(bytes.NewReader(c.avatar))
+		if err != nil {
+			circle := clip.Ellipse{Max: image.Pt(dim, dim)}.Op(gtx.Ops)
+			paint.FillShape(gtx.Ops, blue, circle)
+			return layout.Dimensions{Size: image.Pt(dim, dim)}
+		}
+		img := image.NewRGBA(image.Rectangle{Max: image.Point{X: dim, Y: dim}})
+		draw.CatmullRom.Scale(img, img.Bounds(), decoded, decoded.Bounds(), draw.Src, nil)
+		imgWidget := widget.Image{Src: paint.NewImageOp(img)}
+		imgWidget.Scale = float32(dim) / float32(gtx.Dp(unit.Dp(float32(dim))))
+		return imgWidget.Layout(gtx)
+	} else {
+		circle := clip.Ellipse{Max: image.Pt(dim, dim)}.Op(gtx.Ops)
+		paint.FillShape(gtx.Ops, blue, circle)
+		return layout.Dimensions{Size: image.Pt(dim, dim)}
+	}
+}
+
+// layoutBadge draws the presence of the user over the corner of the avatar
+func (c *UserCard) layoutBadge(gtx layout.Context) layout.Dimensions {
+	if c.room {
+		return layout.Dimensions{}
+	}
+	var badge color.NRGBA
+	switch c.user.Presence {
+	case chatProto.PRESENCE_AWAY:
+		badge = amber
+	case chatProto.PRESENCE_BUSY:
+		badge = red
+	case chatProto.PRESENCE_INVISIBLE:
+		badge = lightGrey
+	default:
+		badge = green
+	}
+	dim := gtx.Dp(unit.Dp(12))
+	circle := clip.Ellipse{Max: image.Pt(dim, dim)}.Op(gtx.Ops)
+	paint.FillShape(gtx.Ops, badge, circle)
+	return layout.Dimensions{Size: image.Pt(dim, dim)}
+}
@@ -7,10 +7,10 @@ import (
 	"log"
 	"slices"
 	"strings"
+	"sync/atomic"
 
 	"gioui.org/layout"
 	"gioui.org/widget/material"
-	"golang.org/x/exp/maps"
 )
 
 var blue = color.NRGBA{R: 0x40, G: 0x40, B: 0xC0, A: 0xFF}
@@ -20,7 +20,9 @@ type UserList struct {
 	list              layout.List
 	userCards         []*UserCard
 	changeUserChannel chan<- string
-	selected          string
+	selected          *string
+	// set when the users or their conversations changed
+	dirty atomic.Bool
 }
 
 func (list *UserList) processClickEvents(gtx layout.Context) {
@@ -28,7 +30,7 @@ func (list *UserList) processClickEvents(gtx layout.Context) {
 		if card.btn.Clicked(gtx) {
 			log.Printf("click on item %d\n", i)
 			list.changeUserChannel <- card.user.Id
-			list.selected = card.user.Id
+			*list.selected = card.user.Id
 		}
 	}
 }
@@ -36,7 +38,7 @@ func (list *UserList) processClickEvents(gtx layout.Context) {
 func filterMessages(messages []*domain.Message) []*domain.Message {
 	res := []*domain.Message{}
 	for _, m := range messages {
-		if m.Type == chatProto.CMD_SEND_MSG_SINGLE {
+		if m.Type == chatProto.CMD_SEND_MSG_SINGLE || m.Type == chatProto.CMD_SEND_MSG_ROOM {
 			res = append(res, m)
 		}
 	}
@@ -45,26 +47,25 @@ func filterMessages(messages []*domain.Message) []*domain.Message {
 
 func (list *UserList) getLastMessage(user *domain.User) string {
 	message := "Say Hi!"
-	historyMsgs := list.client.ChatHistory[user.Id].Messages
+	history, _ := list.client.History(user.Id)
+	historyMsgs := history.Messages
 	if len(historyMsgs) > 0 {
 		historyMsgs = filterMessages(historyMsgs)
-		slices.SortFunc(historyMsgs, func(a, b *domain.Message) int {
-			if a.Timestamp.Before(b.Timestamp) {
-				return -1
-			} else if a.Timestamp.After(b.Timestamp) {
-				return 1
-			}
-			return 0
-		})
 		if len(historyMsgs) > 0 {
-			return string(historyMsgs[len(historyMsgs)-1].Content)
+			return lastMessage(historyMsgs)
 		}
 	}
 	return message
 }
 
+// lastMessage returns the content of the most recent of the messages, the
+// history is ordered oldest first
+func lastMessage(messages []*domain.Message) string {
+	return string(messages[len(messages)-1].Content)
+}
+
 func (list *UserList) updateUserCards() {
-	users := maps.Values(list.client.ActiveUsers)
+	users := list.client.ActiveUsers()
 	slices.SortFunc(users, func(a, b *domain.User) int {
 		if strings.ToLower(a.Name) < strings.ToLower(b.Name) {
 			return -1
@@ -87,20 +88,19 @@ func (list *UserList) updateUserCards() {
 	for i, user := range users {
 		if i < len(list.userCards) {
 			message := list.getLastMessage(user)
-			seen := list.client.ChatHistory[user.Id].Unread
-			selected := user.Id == list.selected
+			history, _ := list.client.History(user.Id)
 			if list.userCards[i] == nil {
 				list.userCards[i] = &UserCard{
-					user:     user,
-					message:  message,
-					unread:   seen,
-					selected: selected,
+					user:    user,
+					avatar:  list.client.Avatar(user),
+					message: message,
+					unread:  history.Unread,
 				}
 			} else {
 				list.userCards[i].user = user
+				list.userCards[i].avatar = list.client.Avatar(user)
 				list.userCards[i].message = message
-				list.userCards[i].unread = seen
-				list.userCards[i].selected = selected
+				list.userCards[i].unread = history.Unread
 			}
 		}
 	}
@@ -109,8 +109,13 @@ func (list *UserList) updateUserCards() {
 }
 
 func (list *UserList) Layout(gtx layout.Context, theme *material.Theme) layout.Dimensions {
-	list.updateUserCards()
+	if list.dirty.Swap(false) {
+		list.updateUserCards()
+	}
 	list.processClickEvents(gtx)
+	for _, card := range list.userCards {
+		card.selected = card.user.Id == *list.selected
+	}
 	return list.list.Layout(gtx, len(list.userCards), func(gtx layout.Context, index int) layout.Dimensions {
 		return list.userCards[index].Layout(gtx, theme)
 	})
@@ -1,51 +1,118 @@
 package ui
 
 import (
+	"errors"
+	"example/zerochat/chatProto"
 	"example/zerochat/chatProto/domain"
+	chatErrors "example/zerochat/chatProto/errors"
+	"time"
 
 	"gioui.org/layout"
+	"gioui.org/op"
 	"gioui.org/unit"
+	"gioui.org/widget"
 	"gioui.org/widget/material"
 )
 
 type UsersPanel struct {
-	userList  UserList
-	selfCard  UserCard
-	ConnError bool
+	client   *domain.Client
+	userList UserList
+	roomList RoomList
+	selfCard UserCard
+	selected string
+	// opens the profile editor, the button is hidden when not set
+	OnEditProfile func()
+	editButton    widget.Clickable
 }
 
 func CreateUsersPanel(client *domain.Client, changeUserChannel chan<- string) *UsersPanel {
-	return &UsersPanel{
-		selfCard: UserCard{message: "Your Profile", user: client.User},
+	up := &UsersPanel{
+		client:   client,
+		selfCard: UserCard{message: "Your Profile"},
 		userList: UserList{
 			client:            client,
 			list:              layout.List{Axis: layout.Vertical},
 			changeUserChannel: changeUserChannel,
 		},
+		roomList: RoomList{
+			client:            client,
+			list:              layout.List{Axis: layout.Vertical},
+			changeUserChannel: changeUserChannel,
+		},
 	}
+	// both lists share the selection so only one card is highlighted
+	up.userList.selected = &up.selected
+	up.roomList.selected = &up.selected
+
+	// the cards are only rebuilt when what they show changed
+	up.userList.dirty.Store(true)
+	up.roomList.dirty.Store(true)
+	client.Subscribe(func(e domain.Event) {
+		switch e.Type {
+		case domain.EVENT_USERS:
+			up.userList.dirty.Store(true)
+		case domain.EVENT_ROOMS:
+			up.roomList.dirty.Store(true)
+		case domain.EVENT_HISTORY:
+			up.userList.dirty.Store(true)
+			up.roomList.dirty.Store(true)
+		case domain.EVENT_AVATAR:
+			up.userList.dirty.Store(true)
+		}
+	})
+	return up
 }
 
 func (up *UsersPanel) processClickEvents(gtx layout.Context) {
+	if up.editButton.Clicked(gtx) && up.OnEditProfile != nil {
+		up.OnEditProfile()
+	}
 	if up.selfCard.btn.Clicked(gtx) {
 		up.userList.changeUserChannel <- up.selfCard.user.Id
+		up.selected = up.selfCard.user.Id
 	}
 }
 
 func (up *UsersPanel) Layout(gtx layout.Context, theme *material.Theme) layout.Dimensions {
 	up.processClickEvents(gtx)
+	// our profile can change during the session
+	up.selfCard.user = up.client.User()
+	up.selfCard.avatar = up.client.Avatar(up.selfCard.user)
 	return layout.Flex{Axis: layout.Vertical}.Layout(
 		gtx,
 		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
 			return layout.Inset{Bottom: unit.Dp(10), Left: unit.Dp(5)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
 				var title material.LabelStyle
-				if up.ConnError {
-					title = material.H6(theme, "You - No Connection")
+				var rejected chatErrors.ChatServerConnectionError
+				var outdated chatErrors.ProtocolVersionError
+				conn := up.client.Connection()
+				if errors.As(conn.Err, &rejected) {
+					title = material.H6(theme, "You - Rejected: "+string(rejected))
+					title.Color = red
+				} else if errors.As(conn.Err, &outdated) {
+					title = material.H6(theme, "You - Update needed: "+string(outdated))
+					title.Color = red
+				} else if conn.State != domain.STATE_ONLINE {
+					title = material.H6(theme, "You - "+conn.String())
 					title.Color = red
+					if conn.State == domain.STATE_RETRYING {
+						// keep the countdown running
+						gtx.Execute(op.InvalidateCmd{At: gtx.Now.Add(time.Second)})
+					}
 				} else {
 					title = material.H6(theme, "You")
 				}
 
-				return title.Layout(gtx)
+				if up.OnEditProfile == nil || !up.client.Supports(chatProto.CAP_PROFILES) {
+					return title.Layout(gtx)
+				}
+				return layout.Flex{Alignment: layout.Middle}.Layout(
+					gtx,
+					layout.Flexed(1, title.Layout),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						return material.Button(theme, &up.editButton, "Edit").Layout(gtx)
+					}),
+				)
 			})
 		}),
 		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
@@ -62,5 +129,14 @@ func (up *UsersPanel) Layout(gtx layout.Context, theme *material.Theme) layout.D
 		layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
 			return up.userList.Layout(gtx, theme)
 		}),
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return layout.Inset{Top: unit.Dp(10), Bottom: unit.Dp(10), Left: unit.Dp(5)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+				title := material.H6(theme, "ROOMS")
+				return title.Layout(gtx)
+			})
+		}),
+		layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+			return up.roomList.Layout(gtx, theme)
+		}),
 	)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"example/zerochat/client/config"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// admission decides which websocket connections the server accepts, before
+// they are upgraded so refused clients get a plain http status
+type admission struct {
+	mutex sync.Mutex
+	// allowed values of the Origin header, empty keeps the same origin check
+	// of the upgrader
+	origins     map[string]bool
+	anyOrigin   bool
+	maxTotal    int
+	maxPerIP    int
+	connections int
+	perIP       map[string]int
+	// proxies whose X-Forwarded-For is believed
+	proxies map[string]bool
+}
+
+// admissionError is why a connection was refused and the http status telling it
+type admissionError struct {
+	status int
+	reason string
+}
+
+func (err *admissionError) Error() string {
+	return err.reason
+}
+
+func newAdmission(cfg config.Config) *admission {
+	admission := &admission{
+		origins:  make(map[string]bool),
+		maxTotal: cfg.MaxConnections,
+		maxPerIP: cfg.MaxConnectionsPerIP,
+		perIP:    make(map[string]int),
+		proxies:  make(map[string]bool),
+	}
+	for _, proxy := range strings.Split(cfg.TrustedProxies, ",") {
+		if ip := net.ParseIP(strings.TrimSpace(proxy)); ip != nil {
+			admission.proxies[ip.String()] = true
+		}
+	}
+	for _, origin := range strings.Split(cfg.AllowedOrigins, ",") {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		if origin == "*" {
+			admission.anyOrigin = true
+		} else if origin != "" {
+			admission.origins[origin] = true
+		}
+	}
+	return admission
+}
+
+// checkOrigin is the CheckOrigin of the upgrader. Our own clients don't send
+// an Origin, browsers do and only the configured pages may connect
+func (admission *admission) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || admission.anyOrigin {
+		return true
+	}
+	if len(admission.origins) == 0 {
+		return sameOrigin(r)
+	}
+	return admission.origins[strings.ToLower(origin)]
+}
+
+// admit takes a connection slot for the client of the request, release must
+// be called once the connection is closed. A limit of 0 means no limit
+func (admission *admission) admit(r *http.Request) (func(), error) {
+	ip := admission.clientIP(r)
+
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+	if admission.maxTotal > 0 && admission.connections >= admission.maxTotal {
+		return nil, &admissionError{
+			status: http.StatusServiceUnavailable,
+			reason: fmt.Sprintf("server is full with %d connections", admission.connections),
+		}
+	}
+	if admission.maxPerIP > 0 && admission.perIP[ip] >= admission.maxPerIP {
+		return nil, &admissionError{
+			status: http.StatusTooManyRequests,
+			reason: fmt.Sprintf("too many connections from %s", ip),
+		}
+	}
+	admission.connections++
+	admission.perIP[ip]++
+
+	release := func() {
+		admission.mutex.Lock()
+		defer admission.mutex.Unlock()
+		admission.connections--
+		admission.perIP[ip]--
+		if admission.perIP[ip] == 0 {
+			delete(admission.perIP, ip)
+		}
+	}
+	return release, nil
+}
+
+// clientIP is the address of the client of the request. Behind trusted
+// proxies it is the last address they did not add themselves to
+// X-Forwarded-For, the ones before could be made up by the client
+func (admission *admission) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && admission.isProxy(ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+	}
+	return ip
+}
+
+func (admission *admission) isProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && admission.proxies[parsed.String()]
+}
+
+// sameOrigin is the default check of the upgrader: the Origin must be the
+// host that was asked for
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	_, host, ok := strings.Cut(origin, "://")
+	return ok && strings.EqualFold(host, r.Host)
+}
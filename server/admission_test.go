@@ -0,0 +1,38 @@
+package main
+
+import (
+	"example/zerochat/client/config"
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	cfg := config.DefaultServerConfig()
+	cfg.TrustedProxies = "127.0.0.1, 10.0.0.2"
+	admission := newAdmission(cfg)
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"direct with made up header", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"behind the proxy", "127.0.0.1:4000", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"client made up the first hop", "127.0.0.1:4000", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"behind two proxies", "127.0.0.1:4000", []string{"203.0.113.7", "10.0.0.2"}, "203.0.113.7"},
+		{"proxy without header", "127.0.0.1:4000", nil, "127.0.0.1"},
+		{"garbage header", "127.0.0.1:4000", []string{"not an ip"}, "127.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := admission.clientIP(r); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// time a client has to answer the authentication challenge
+const AUTH_TIMEOUT = 10 * time.Second
+
+// authenticate makes the client prove it owns the private key of the user it claims to be.
+// On failure the client is told why before the error is returned
+func (hub *hub) authenticate(c *websocket.Conn, user *domain.User) error {
+	if err := hub.checkChallenge(c, user); err != nil {
+		reject(c, chatProto.REJECT_AUTH, err.Error())
+		return err
+	}
+	// before anything is claimed in the name of the user
+	if err := hub.users.checkKey(user); err != nil {
+		reject(c, chatProto.REJECT_AUTH, "user id is registered with another key")
+		return err
+	}
+	if problem := nickNameProblem(user.Name); problem != "" {
+		reject(c, chatProto.REJECT_NICK_INVALID, problem)
+		return fmt.Errorf("invalid nickname %q: %s", user.Name, problem)
+	}
+	claimed, fresh := hub.claimNickName(user.Id, user.Name)
+	if !claimed {
+		reject(c, chatProto.REJECT_NICK_TAKEN, fmt.Sprintf("nickname %s is already taken", user.Name))
+		return fmt.Errorf("nickname %s is already taken", user.Name)
+	}
+	err := hub.users.register(user)
+	if err != nil {
+		reject(c, chatProto.REJECT_AUTH, "user id is registered with another key")
+	} else {
+		err = c.WriteJSON(&domain.Message{Type: chatProto.CMD_AUTH_OK, Reciever: *user})
+	}
+	// another session of the user may hold the nickname
+	if err != nil && fresh {
+		hub.mutex.Lock()
+		hub.releaseNickName(user.Id, user.Name)
+		hub.mutex.Unlock()
+	}
+	return err
+}
+
+func (hub *hub) checkChallenge(c *websocket.Conn, user *domain.User) error {
+	challenge := make([]byte, chatProto.AUTH_CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		return fmt.Errorf("failed to generate challenge")
+	}
+	err := c.WriteJSON(&domain.Message{Type: chatProto.CMD_AUTH_CHALLENGE, Content: challenge})
+	if err != nil {
+		return fmt.Errorf("failed to send challenge")
+	}
+
+	c.SetReadDeadline(time.Now().Add(AUTH_TIMEOUT))
+	defer c.SetReadDeadline(time.Time{})
+	var resp domain.Message
+	if err := c.ReadJSON(&resp); err != nil {
+		return fmt.Errorf("no answer to challenge")
+	}
+	if resp.Type != chatProto.CMD_AUTH_RESPONSE {
+		return fmt.Errorf("expected %s but got %s", chatProto.CMD_AUTH_RESPONSE, resp.Type)
+	}
+	if !domain.VerifyChallenge(user, challenge, resp.Content) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// reject tells the client why its connection is refused
+func reject(c *websocket.Conn, code string, reason string) {
+	content, err := json.Marshal(&domain.Rejection{Code: code, Reason: reason})
+	if err != nil {
+		log.Printf("failed to marshall rejection %s\n", err)
+		return
+	}
+	err = c.WriteJSON(&domain.Message{Type: chatProto.CMD_CONN_REJECTED, Content: content})
+	if err != nil {
+		log.Printf("failed to send rejection %s\n", err)
+	}
+}
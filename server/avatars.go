@@ -0,0 +1,34 @@
+package main
+
+import (
+	"example/zerochat/chatProto"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// serveAvatar answers GET /avatar/<hash> with the avatar of that hash. An
+// avatar is addressed by its content so it never changes and can be cached
+// forever, the hash is also its ETag
+func (hub *hub) serveAvatar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, chatProto.AVATAR_PATH)
+	avatar, ok := hub.users.avatar(hash)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := fmt.Sprintf("%q", hash)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(avatar))
+	w.Write(avatar)
+}
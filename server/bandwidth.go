@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// the bandwidth used by the websocket connections is published in the metrics
+// twice: what went through the sockets, after compression and framing, and the
+// payload of the frames before compression, so the gain can be measured. The
+// handshake frames are only counted as bytes
+const (
+	METRIC_BYTES_IN    = "bytes_in"
+	METRIC_BYTES_OUT   = "bytes_out"
+	METRIC_PAYLOAD_IN  = "payload_bytes_in"
+	METRIC_PAYLOAD_OUT = "payload_bytes_out"
+)
+
+// countingConn counts the bytes read from and written to the socket
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	metrics.Add(METRIC_BYTES_IN, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	metrics.Add(METRIC_BYTES_OUT, int64(n))
+	return n, err
+}
+
+// countingWriter hands the websocket upgrader a counting connection when it
+// takes over the socket from the http server
+type countingWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil || brw.Reader.Buffered() > 0 {
+		// the upgrader refuses clients that already sent data anyway
+		return conn, brw, err
+	}
+	counted := countingConn{conn}
+	return counted, bufio.NewReadWriter(bufio.NewReader(counted), bufio.NewWriter(counted)), nil
+}
+
+// writeMessage is domain.WriteMessage counting the payload
+func writeMessage(c *websocket.Conn, codec domain.Codec, msg *domain.Message) error {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	metrics.Add(METRIC_PAYLOAD_OUT, int64(len(data)))
+	return c.WriteMessage(codec.FrameType(), data)
+}
+
+// readMessage is domain.ReadMessage counting the payload. The read limit of
+// the connection only applies to compressed frames so the payload is limited
+// to maxSize too, 0 for no limit
+func readMessage(c *websocket.Conn, codec domain.Codec, maxSize int, msg *domain.Message) error {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 {
+		r = io.LimitReader(r, int64(maxSize)+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && len(data) > maxSize {
+		closing := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+		c.WriteControl(websocket.CloseMessage, closing, time.Now().Add(chatProto.WRITE_TIMEOUT))
+		return fmt.Errorf("frame bigger than %d bytes", maxSize)
+	}
+	metrics.Add(METRIC_PAYLOAD_IN, int64(len(data)))
+	return codec.Unmarshal(data, msg)
+}
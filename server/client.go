@@ -0,0 +1,154 @@
+package main
+
+import (
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"example/zerochat/client/config"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// what happens to a message for a client whose send queue is full
+const (
+	SLOW_CONSUMER_DROP_OLDEST = "drop-oldest"
+	SLOW_CONSUMER_DISCONNECT  = "disconnect"
+	SLOW_CONSUMER_SPILL       = "spill"
+)
+
+// counters published on /debug/vars
+var metrics = expvar.NewMap("zerochat")
+
+// numbers the sessions, a user may be connected from several devices
+var lastSession atomic.Uint64
+
+type client struct {
+	// replaced when the user changes its profile, from any of its sessions
+	user atomic.Pointer[domain.User]
+	// unique to this connection, the offline queue keeps what it spilled under it
+	session   string
+	conn      *websocket.Conn
+	writeChan chan *domain.Message
+	// features and encoding of the frames agreed on in the hello
+	capabilities map[string]bool
+	codec        domain.Codec
+
+	// guards writeChan against sends after close and the spilling state
+	mutex  sync.Mutex
+	closed bool
+	// while set, messages go to the offline queue until the writer caught up
+	spilling bool
+
+	// frames the client may still send, see rateLimiter
+	frames tokenBucket
+}
+
+func newClient(user *domain.User, conn *websocket.Conn, cfg config.Config, agreed *domain.Hello) *client {
+	codec, _ := domain.CodecByName(agreed.Codecs[0])
+	cli := &client{
+		session:      fmt.Sprintf("%s/%d", user.Id, lastSession.Add(1)),
+		conn:         conn,
+		writeChan:    make(chan *domain.Message, max(cfg.SendQueueSize, 1)),
+		capabilities: make(map[string]bool),
+		codec:        codec,
+		frames:       newTokenBucket(cfg.FrameRate, cfg.FrameBurst),
+	}
+	cli.user.Store(user)
+	for _, capability := range agreed.Capabilities {
+		cli.capabilities[capability] = true
+	}
+	return cli
+}
+
+// supports reports if the client understands the command
+func (cli *client) supports(cmd string) bool {
+	capability := chatProto.CapabilityOf(cmd)
+	return capability == "" || cli.capabilities[capability]
+}
+
+// send queues the message for the client without ever blocking, see enqueue.
+// Messages of features the client did not agree on are skipped
+func (hub *hub) send(cli *client, msg *domain.Message) bool {
+	if !cli.supports(msg.Type) {
+		return true
+	}
+	return hub.enqueue(cli, msg)
+}
+
+// reply queues the response to a request of the client, behind what was
+// already queued for it. It is never skipped, the client asked for it
+func (hub *hub) reply(cli *client, msg *domain.Message) bool {
+	return hub.enqueue(cli, msg)
+}
+
+// enqueue adds the message to the send queue of the client without ever
+// blocking. When the queue is full the slow consumer policy decides what
+// happens. It returns false if the message won't reach the client, because it
+// is gone or was disconnected for being too slow
+func (hub *hub) enqueue(cli *client, msg *domain.Message) bool {
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
+	if cli.closed {
+		return false
+	}
+	if cli.spilling {
+		metrics.Add("slow_consumer_spilled", 1)
+		hub.spilled.push(cli.session, msg)
+		return true
+	}
+	select {
+	case cli.writeChan <- msg:
+		return true
+	default:
+	}
+
+	switch hub.cfg.SlowConsumerPolicy {
+	case SLOW_CONSUMER_DISCONNECT:
+		log.Printf("send queue of %s is full, disconnecting\n", cli.user.Load())
+		metrics.Add("slow_consumer_disconnects", 1)
+		// the read loop fails and cleans up the client
+		cli.conn.Close()
+		return false
+	case SLOW_CONSUMER_SPILL:
+		log.Printf("send queue of %s is full, spilling\n", cli.user.Load())
+		metrics.Add("slow_consumer_spilled", 1)
+		cli.spilling = true
+		hub.spilled.push(cli.session, msg)
+	default:
+		select {
+		case <-cli.writeChan:
+		default:
+		}
+		metrics.Add("slow_consumer_dropped", 1)
+		select {
+		case cli.writeChan <- msg:
+		default:
+			metrics.Add("slow_consumer_dropped", 1)
+		}
+	}
+	return true
+}
+
+// takeSpilled returns the messages that did not fit in the send queue, in
+// order, and stops spilling. Only the writer calls it, once the queue is empty
+func (hub *hub) takeSpilled(cli *client) []*domain.Message {
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
+	if !cli.spilling {
+		return nil
+	}
+	cli.spilling = false
+	return hub.spilled.take(cli.session)
+}
+
+// close stops any further send and ends the writer
+func (cli *client) close() {
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
+	cli.closed = true
+	close(cli.writeChan)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"log"
+)
+
+// requestError is a refused request. The client is told why with a CMD_ERROR
+type requestError struct {
+	code   string
+	reason string
+}
+
+func (err *requestError) Error() string {
+	return err.reason
+}
+
+func refuse(code string, format string, args ...any) error {
+	return &requestError{code: code, reason: fmt.Sprintf(format, args...)}
+}
+
+// errorFrame builds the CMD_ERROR answering the request that failed. Other
+// failures than refusals are reported without details, those stay in the log
+func errorFrame(request *domain.Message, err error) *domain.Message {
+	info := domain.ErrorInfo{
+		Code:    chatProto.ERR_INTERNAL,
+		Reason:  "internal server error",
+		Command: request.Type,
+	}
+	var refused *requestError
+	if errors.As(err, &refused) {
+		info.Code = refused.code
+		info.Reason = refused.reason
+	}
+	content, err := json.Marshal(&info)
+	if err != nil {
+		log.Printf("failed to marshall error %s\n", err)
+	}
+	return &domain.Message{
+		Type:      chatProto.CMD_ERROR,
+		Id:        request.Id,
+		RequestId: request.RequestId,
+		Reciever:  request.Sender,
+		Room:      request.Room,
+		Content:   content,
+	}
+}
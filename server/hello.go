@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// hello reads the CMD_HELLO that opens a session and answers with the version,
+// the capabilities and the codec both sides support. Incompatible clients are
+// rejected
+func (hub *hub) hello(c *websocket.Conn) (*domain.User, *domain.Hello, error) {
+	c.SetReadDeadline(time.Now().Add(AUTH_TIMEOUT))
+	defer c.SetReadDeadline(time.Time{})
+
+	var message domain.Message
+	if err := c.ReadJSON(&message); err != nil {
+		return nil, nil, fmt.Errorf("failed reading hello %s", err)
+	}
+	user := message.Sender
+	if message.Type != chatProto.CMD_HELLO {
+		// clients before the hello started by sending their user
+		reject(c, chatProto.REJECT_VERSION, "client is too old, please update it")
+		return nil, nil, fmt.Errorf("no hello from client")
+	}
+
+	var offer domain.Hello
+	if err := json.Unmarshal(message.Content, &offer); err != nil {
+		reject(c, chatProto.REJECT_HANDSHAKE, "malformed hello")
+		return nil, nil, fmt.Errorf("failed to unmarshall hello %s", err)
+	}
+	if offer.Version < chatProto.MIN_PROTOCOL_VERSION {
+		reject(c, chatProto.REJECT_VERSION, fmt.Sprintf(
+			"protocol version %d is not supported anymore, at least %d is needed",
+			offer.Version, chatProto.MIN_PROTOCOL_VERSION,
+		))
+		return nil, nil, fmt.Errorf("unsupported protocol version %d", offer.Version)
+	}
+
+	agreed := &domain.Hello{
+		Version:      min(offer.Version, chatProto.PROTOCOL_VERSION),
+		Capabilities: []string{},
+	}
+	for _, capability := range chatProto.CAPABILITIES {
+		if slices.Contains(offer.Capabilities, capability) {
+			agreed.Capabilities = append(agreed.Capabilities, capability)
+		}
+	}
+	// the first codec of the client we know, older clients only speak JSON
+	agreed.Codecs = []string{chatProto.CODEC_JSON}
+	for _, name := range offer.Codecs {
+		if _, ok := domain.CodecByName(name); ok {
+			agreed.Codecs = []string{name}
+			break
+		}
+	}
+	// clients may come back invisible or with their status, the answer tells
+	// them the presence they really got
+	if presenceProblem(&domain.Presence{State: user.Presence, Text: user.StatusText}) != "" {
+		user.Presence = chatProto.PRESENCE_ONLINE
+		user.StatusText = ""
+	}
+	content, err := json.Marshal(agreed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshall hello %s", err)
+	}
+	err = c.WriteJSON(answer(&message, &domain.Message{Type: chatProto.CMD_HELLO_OK, Reciever: user, Content: content}))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to answer hello %s", err)
+	}
+	return &user, agreed, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"strings"
+)
+
+// nickNameProblem tells why the nickname can't be used, "" when it can
+func nickNameProblem(name string) string {
+	if name == "" {
+		return "empty nickname"
+	}
+	if len(name) > chatProto.MAX_NICK_LENGTH {
+		return fmt.Sprintf("nickname longer than %d characters", chatProto.MAX_NICK_LENGTH)
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			return "nickname can only contain letters, digits and _"
+		}
+	}
+	return ""
+}
+
+// claimNickName reserves the nickname for the user until releaseNickName. It
+// fails when another online user has it, whatever the case. fresh is false
+// when the user already had it, another session still uses it then and a
+// failing caller must not release it
+func (hub *hub) claimNickName(userId string, name string) (claimed bool, fresh bool) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return hub.claimNickNameLocked(userId, name)
+}
+
+// claimNickNameLocked is claimNickName for callers holding the mutex
+func (hub *hub) claimNickNameLocked(userId string, name string) (claimed bool, fresh bool) {
+	key := strings.ToLower(name)
+	owner, ok := hub.nickNames[key]
+	if ok && owner != userId {
+		return false, false
+	}
+	hub.nickNames[key] = userId
+	return true, !ok
+}
+
+// releaseNickName frees the nickname if the user still owns it. The caller
+// must hold the mutex
+func (hub *hub) releaseNickName(userId string, name string) {
+	key := strings.ToLower(name)
+	if hub.nickNames[key] == userId {
+		delete(hub.nickNames, key)
+	}
+}
+
+// changeNickName renames the user of the client, keeping the rest of its profile
+func (hub *hub) changeNickName(client *client, message *domain.Message) (*domain.Message, error) {
+	profile, ok := hub.users.profile(client.user.Load().Id)
+	if !ok {
+		return nil, fmt.Errorf("failed to change nickname of unknown user %s", client.user.Load())
+	}
+	profile.Name = string(message.Content)
+	return hub.updateProfile(client, profile)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"example/zerochat/client/config"
+	"strings"
+	"testing"
+)
+
+func TestNickNameProblem(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"alice", true},
+		{"Alice_42", true},
+		{"", false},
+		{"alice smith", false},
+		{"élise", false},
+		{"a-b", false},
+		{strings.Repeat("a", 20), true},
+		{strings.Repeat("a", 21), false},
+	}
+	for _, test := range tests {
+		if got := nickNameProblem(test.name) == ""; got != test.ok {
+			t.Errorf("nickname %q: got ok %v, want %v", test.name, got, test.ok)
+		}
+	}
+}
+
+func TestClaimNickName(t *testing.T) {
+	hub := InitHub(config.DefaultServerConfig(), nil, nil, newMemoryStore(), newOfflineQueue("offline", 0, 0))
+	steps := []struct {
+		user, name     string
+		claimed, fresh bool
+	}{
+		{"alice", "alice", true, true},
+		// another session of the same user
+		{"alice", "alice", true, false},
+		{"mallory", "ALICE", false, false},
+		{"mallory", "Alice", false, false},
+		{"bob", "bob", true, true},
+		{"alice", "Bob", false, false},
+	}
+	for i, step := range steps {
+		claimed, fresh := hub.claimNickName(step.user, step.name)
+		if claimed != step.claimed || fresh != step.fresh {
+			t.Errorf("step %d: %s claiming %s got %v %v, want %v %v", i, step.user, step.name, claimed, fresh, step.claimed, step.fresh)
+		}
+	}
+
+	hub.mutex.Lock()
+	// only the owner can release it
+	hub.releaseNickName("mallory", "alice")
+	hub.mutex.Unlock()
+	if claimed, _ := hub.claimNickName("mallory", "alice"); claimed {
+		t.Errorf("mallory released the nickname of alice")
+	}
+
+	hub.mutex.Lock()
+	hub.releaseNickName("alice", "ALICE")
+	hub.mutex.Unlock()
+	if claimed, fresh := hub.claimNickName("mallory", "alice"); !claimed || !fresh {
+		t.Errorf("nickname still taken once released")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"unicode/utf8"
+)
+
+// visible reports if the others may know that the user is online
+func visible(user *domain.User) bool {
+	return user.Presence != chatProto.PRESENCE_INVISIBLE
+}
+
+// presenceProblem tells why the presence can't be used, "" when it can
+func presenceProblem(presence *domain.Presence) string {
+	switch presence.State {
+	case "", chatProto.PRESENCE_ONLINE, chatProto.PRESENCE_AWAY, chatProto.PRESENCE_BUSY, chatProto.PRESENCE_INVISIBLE:
+	default:
+		return fmt.Sprintf("unknown presence %q", presence.State)
+	}
+	if utf8.RuneCountInString(presence.Text) > chatProto.MAX_STATUS_LENGTH {
+		return fmt.Sprintf("status longer than %d characters", chatProto.MAX_STATUS_LENGTH)
+	}
+	return ""
+}
+
+// setPresence applies the presence sent in a CMD_SET_PRESENCE
+func (hub *hub) setPresence(client *client, message *domain.Message) (*domain.Message, error) {
+	var presence domain.Presence
+	if err := json.Unmarshal(message.Content, &presence); err != nil {
+		return nil, refuse(chatProto.ERR_BAD_REQUEST, "failed to unmarshall presence %s", err)
+	}
+	if problem := presenceProblem(&presence); problem != "" {
+		return nil, refuse(chatProto.ERR_BAD_REQUEST, "failed to set presence. %s", problem)
+	}
+
+	previous, updated := hub.replaceUser(client, func(user *domain.User) {
+		user.Presence = presence.State
+		user.StatusText = presence.Text
+	})
+
+	hub.announce(previous, updated)
+	hub.syncSessions(client, &domain.Message{Type: chatProto.CMD_USER_UPDATED, Sender: *updated})
+	return &domain.Message{Type: chatProto.CMD_USER_UPDATED, Sender: *updated}, nil
+}
+
+// announce tells the others that the user changed. Seen from the outside an
+// invisible user is offline, so becoming invisible is a disconnection
+func (hub *hub) announce(previous *domain.User, updated *domain.User) {
+	var cmd string
+	switch {
+	case visible(previous) && visible(updated):
+		cmd = chatProto.CMD_USER_UPDATED
+	case visible(updated):
+		cmd = chatProto.CMD_USER_CONNECTED
+	case visible(previous):
+		cmd = chatProto.CMD_USER_DISCONNECTED
+	default:
+		return
+	}
+	hub.broadcast(&domain.Message{Type: cmd, Sender: *updated}, updated.Id)
+}
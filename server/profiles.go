@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// avatarProblem tells why the avatar can't be used, "" when it can. No
+// avatar is fine, the clients draw a placeholder
+func avatarProblem(avatar []byte) string {
+	if len(avatar) > domain.MAX_AVATAR_SIZE {
+		return fmt.Sprintf("avatar bigger than %d bytes", domain.MAX_AVATAR_SIZE)
+	}
+	if len(avatar) > 0 && !strings.HasPrefix(http.DetectContentType(avatar), "image/") {
+		return "avatar is not an image"
+	}
+	return ""
+}
+
+// changeProfile applies the profile sent in a CMD_UPDATE_PROFILE
+func (hub *hub) changeProfile(client *client, message *domain.Message) (*domain.Message, error) {
+	var profile domain.Profile
+	if err := json.Unmarshal(message.Content, &profile); err != nil {
+		return nil, refuse(chatProto.ERR_BAD_REQUEST, "failed to unmarshall profile %s", err)
+	}
+	return hub.updateProfile(client, &profile)
+}
+
+// updateProfile changes the nickname and the avatar of the user of the client
+// and tells everyone else
+func (hub *hub) updateProfile(client *client, profile *domain.Profile) (*domain.Message, error) {
+	if problem := nickNameProblem(profile.Name); problem != "" {
+		return nil, refuse(chatProto.ERR_NICK_INVALID, "failed to update profile. %s", problem)
+	}
+	if problem := avatarProblem(profile.Avatar); problem != "" {
+		return nil, refuse(chatProto.ERR_AVATAR_INVALID, "failed to update profile. %s", problem)
+	}
+	user := client.user.Load()
+	claimed, fresh := hub.claimNickName(user.Id, profile.Name)
+	if !claimed {
+		return nil, refuse(chatProto.ERR_NICK_TAKEN, "failed to update profile. %s is already taken", profile.Name)
+	}
+	// the new avatar must be served before anyone hears of its hash
+	if err := hub.users.updateProfile(user.Id, profile); err != nil {
+		if fresh {
+			hub.mutex.Lock()
+			hub.releaseNickName(user.Id, profile.Name)
+			hub.mutex.Unlock()
+		}
+		return nil, fmt.Errorf("failed to save profile of %s: %s", user, err)
+	}
+
+	previous, updated := hub.replaceUser(client, func(user *domain.User) {
+		if !strings.EqualFold(user.Name, profile.Name) {
+			hub.releaseNickName(user.Id, user.Name)
+		}
+		user.Name = profile.Name
+		user.AvatarHash = domain.AvatarHash(profile.Avatar)
+	})
+
+	log.Printf("%s updated its profile, now %s\n", previous, updated)
+	hub.announce(previous, updated)
+	hub.syncSessions(client, &domain.Message{Type: chatProto.CMD_USER_UPDATED, Sender: *updated})
+	// the sender gets its own copy, it carries the id of its request
+	return &domain.Message{Type: chatProto.CMD_USER_UPDATED, Sender: *updated}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"example/zerochat/chatProto/domain"
+	"log"
+	"sync"
+	"time"
+)
+
+type queuedMessage struct {
+	message *domain.Message
+	expires time.Time
+}
+
+// offlineQueue holds the messages sent to users that are currently offline
+// until they connect again. The hub has a second one for what slow clients
+// spilled, see SLOW_CONSUMER_SPILL
+type offlineQueue struct {
+	// prefix of the metrics counting the lost messages
+	name     string
+	mutex    sync.Mutex
+	capacity int
+	// messages never expire without it
+	ttl    time.Duration
+	queues map[string][]queuedMessage
+}
+
+func newOfflineQueue(name string, capacity int, ttl time.Duration) *offlineQueue {
+	return &offlineQueue{
+		name:     name,
+		capacity: capacity,
+		ttl:      ttl,
+		queues:   make(map[string][]queuedMessage),
+	}
+}
+
+// push adds the message at the end of the queue of the user. When the queue
+// is full the oldest message is dropped
+func (queue *offlineQueue) push(userId string, message *domain.Message) {
+	if queue.capacity <= 0 {
+		metrics.Add(queue.name+"_dropped", 1)
+		return
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pending := queue.unexpired(userId)
+	if len(pending) >= queue.capacity {
+		dropped := len(pending) - queue.capacity + 1
+		log.Printf("%s queue of %s is full, dropping %d messages\n", queue.name, userId, dropped)
+		metrics.Add(queue.name+"_dropped", int64(dropped))
+		pending = pending[dropped:]
+	}
+	var expires time.Time
+	if queue.ttl > 0 {
+		expires = time.Now().Add(queue.ttl)
+	}
+	queue.queues[userId] = append(pending, queuedMessage{
+		message: message,
+		expires: expires,
+	})
+}
+
+// take empties the queue of the user and returns the messages in the order
+// they were pushed
+func (queue *offlineQueue) take(userId string) []*domain.Message {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pending := queue.unexpired(userId)
+	delete(queue.queues, userId)
+	messages := make([]*domain.Message, 0, len(pending))
+	for _, queued := range pending {
+		messages = append(messages, queued.message)
+	}
+	return messages
+}
+
+// unexpired returns the queue of the user without the expired messages.
+// The caller must hold the mutex
+func (queue *offlineQueue) unexpired(userId string) []queuedMessage {
+	pending := queue.queues[userId]
+	now := time.Now()
+	i := 0
+	for i < len(pending) && !pending[i].expires.IsZero() && pending[i].expires.Before(now) {
+		i++
+	}
+	if i > 0 {
+		log.Printf("%d queued messages for %s expired\n", i, userId)
+		metrics.Add(queue.name+"_expired", int64(i))
+	}
+	return pending[i:]
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"example/zerochat/chatProto/domain"
+	"testing"
+	"time"
+)
+
+func TestOfflineQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		ttl      time.Duration
+		push     []string
+		wait     time.Duration
+		want     []string
+	}{
+		{"in order", 10, time.Minute, []string{"1", "2", "3"}, 0, []string{"1", "2", "3"}},
+		{"oldest dropped when full", 2, time.Minute, []string{"1", "2", "3"}, 0, []string{"2", "3"}},
+		{"disabled", 0, time.Minute, []string{"1"}, 0, []string{}},
+		{"expired", 10, 10 * time.Millisecond, []string{"1", "2"}, 20 * time.Millisecond, []string{}},
+		{"no ttl never expires", 10, 0, []string{"1", "2"}, 20 * time.Millisecond, []string{"1", "2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := newOfflineQueue("offline", test.capacity, test.ttl)
+			for _, id := range test.push {
+				queue.push("bob", &domain.Message{Id: id})
+			}
+			time.Sleep(test.wait)
+			got := []string{}
+			for _, msg := range queue.take("bob") {
+				got = append(got, msg.Id)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+			if left := queue.take("bob"); len(left) != 0 {
+				t.Errorf("%d messages left after take", len(left))
+			}
+		})
+	}
+}
+
+func TestOfflineQueueExpiresOldestOnly(t *testing.T) {
+	queue := newOfflineQueue("offline", 10, 30*time.Millisecond)
+	queue.push("bob", &domain.Message{Id: "old"})
+	time.Sleep(40 * time.Millisecond)
+	queue.push("bob", &domain.Message{Id: "new"})
+	got := queue.take("bob")
+	if len(got) != 1 || got[0].Id != "new" {
+		t.Errorf("got %d messages, want only the new one", len(got))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"example/zerochat/client/config"
+	"log"
+	"sync"
+	"time"
+)
+
+// what happens to a user that keeps hitting the rate limits
+const (
+	RATE_LIMIT_PENALTY_MUTE       = "mute"
+	RATE_LIMIT_PENALTY_DISCONNECT = "disconnect"
+)
+
+// refusals counted against a user are forgotten after this long
+const RATE_LIMIT_STRIKE_WINDOW = time.Minute
+
+// tokenBucket allows burst actions at once and then rate actions per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) tokenBucket {
+	return tokenBucket{rate: float64(rate), burst: float64(max(burst, 1)), tokens: float64(max(burst, 1))}
+}
+
+// take reports if an action is allowed now, a rate of 0 allows everything
+func (bucket *tokenBucket) take(now time.Time) bool {
+	if bucket.rate <= 0 {
+		return true
+	}
+	if !bucket.last.IsZero() {
+		bucket.tokens = min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// userLimit is kept for the user across connections, reconnecting doesn't
+// give a flooder a full bucket nor lifts a mute
+type userLimit struct {
+	messages    tokenBucket
+	strikes     int
+	firstStrike time.Time
+	mutedUntil  time.Time
+}
+
+type rateLimiter struct {
+	cfg   config.Config
+	mutex sync.Mutex
+	users map[string]*userLimit
+}
+
+func newRateLimiter(cfg config.Config) *rateLimiter {
+	return &rateLimiter{cfg: cfg, users: make(map[string]*userLimit)}
+}
+
+// allow checks a frame read from the client against the limit of its
+// connection, and chat messages against the limit of the user as well. When
+// refused, disconnect tells if the client has to go
+func (limiter *rateLimiter) allow(cli *client, message *domain.Message) (disconnect bool, err error) {
+	now := time.Now()
+	// only the read loop of the client uses the bucket of its connection
+	allowed := cli.frames.take(now)
+	chat := message.Type == chatProto.CMD_SEND_MSG_SINGLE || message.Type == chatProto.CMD_SEND_MSG_ROOM
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limit, ok := limiter.users[cli.user.Load().Id]
+	if !ok {
+		limit = &userLimit{messages: newTokenBucket(limiter.cfg.MessageRate, limiter.cfg.MessageBurst)}
+		limiter.users[cli.user.Load().Id] = limit
+	}
+	if chat && now.Before(limit.mutedUntil) {
+		metrics.Add("rate_limited", 1)
+		return false, refuse(chatProto.ERR_RATE_LIMITED, "muted for %s for sending too fast", limit.mutedUntil.Sub(now).Round(time.Second))
+	}
+	if allowed && (!chat || limit.messages.take(now)) {
+		return false, nil
+	}
+
+	metrics.Add("rate_limited", 1)
+	if now.Sub(limit.firstStrike) > RATE_LIMIT_STRIKE_WINDOW {
+		limit.strikes = 0
+		limit.firstStrike = now
+	}
+	limit.strikes++
+	if limiter.cfg.RateLimitStrikes <= 0 || limit.strikes < limiter.cfg.RateLimitStrikes {
+		return false, refuse(chatProto.ERR_RATE_LIMITED, "sending too fast, slow down")
+	}
+
+	limit.strikes = 0
+	if limiter.cfg.RateLimitPenalty == RATE_LIMIT_PENALTY_DISCONNECT {
+		log.Printf("disconnecting %s for flooding\n", cli.user.Load())
+		metrics.Add("rate_limit_disconnects", 1)
+		return true, refuse(chatProto.ERR_RATE_LIMITED, "disconnected for sending too fast")
+	}
+	log.Printf("muting %s for %s for flooding\n", cli.user.Load(), limiter.cfg.MuteDuration)
+	metrics.Add("rate_limit_mutes", 1)
+	limit.mutedUntil = now.Add(limiter.cfg.MuteDuration)
+	return false, refuse(chatProto.ERR_RATE_LIMITED, "muted for %s for sending too fast", limiter.cfg.MuteDuration)
+}
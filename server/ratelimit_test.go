@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		rate, burst int
+		// offsets of the actions from the start
+		at   []time.Duration
+		want []bool
+	}{
+		{"burst then refused", 1, 3, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refills with time", 2, 1, []time.Duration{0, 0, 500 * time.Millisecond, 600 * time.Millisecond}, []bool{true, false, true, false}},
+		{"refill capped at burst", 10, 2, []time.Duration{0, 0, 0, time.Hour, time.Hour, time.Hour}, []bool{true, true, false, true, true, false}},
+		{"no rate allows everything", 0, 1, []time.Duration{0, 0, 0}, []bool{true, true, true}},
+		{"burst of at least one", 1, 0, []time.Duration{0, 0}, []bool{true, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := newTokenBucket(test.rate, test.burst)
+			for i, offset := range test.at {
+				if got := bucket.take(start.Add(offset)); got != test.want[i] {
+					t.Errorf("action %d at %s: got %v, want %v", i, offset, got, test.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"slices"
+)
+
+// ack tells the sender that the hub accepted the message and where it was
+// placed in the conversation
+func ack(message *domain.Message) *domain.Message {
+	return &domain.Message{
+		Type:      chatProto.CMD_ACK,
+		Id:        message.Id,
+		Reciever:  message.Reciever,
+		Room:      message.Room,
+		Seq:       message.Seq,
+		Timestamp: message.Timestamp,
+	}
+}
+
+// notifyDelivered tells the sender that the message was written to the
+// connection of the receiver
+func (hub *hub) notifyDelivered(message *domain.Message) {
+	hub.notify(message.Sender.Id, &domain.Message{
+		Type:     chatProto.CMD_DELIVERED,
+		Id:       message.Id,
+		Sender:   message.Reciever,
+		Reciever: message.Sender,
+	})
+}
+
+// forwardReadReceipt relays to the peer that the conversation was read up to
+// the message with the id of the receipt
+func (hub *hub) forwardReadReceipt(message *domain.Message) {
+	if message.Id == "" || !hub.users.isKnown(message.Reciever.Id) {
+		return
+	}
+	hub.notify(message.Reciever.Id, &domain.Message{
+		Type:     chatProto.CMD_READ,
+		Id:       message.Id,
+		Sender:   message.Sender,
+		Reciever: message.Reciever,
+	})
+}
+
+// notify sends a receipt to the sessions of the user that are online. Receipts
+// are never queued, they would push chat messages out of the offline queue and
+// a restarted client has nothing left to match them with
+func (hub *hub) notify(userId string, receipt *domain.Message) {
+	hub.mutex.Lock()
+	sessions := slices.Clone(hub.clients[userId])
+	hub.mutex.Unlock()
+
+	for _, session := range sessions {
+		hub.send(session, receipt)
+	}
+}
+
+// relayTyping passes the typing indicator to the sessions of the peer or of the
+// members of the room that are online. Nothing is queued since the indicator
+// expires quickly
+func (hub *hub) relayTyping(message *domain.Message) {
+	for _, cli := range hub.typingRecipients(message) {
+		hub.send(cli, message)
+	}
+}
+
+func (hub *hub) typingRecipients(message *domain.Message) []*client {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if message.Room == "" {
+		return slices.Clone(hub.clients[message.Reciever.Id])
+	}
+	room, ok := hub.rooms[message.Room]
+	if !ok || !room.HasMember(message.Sender.Id) {
+		return nil
+	}
+	recipients := []*client{}
+	for _, member := range room.Members {
+		if member != message.Sender.Id {
+			recipients = append(recipients, hub.clients[member]...)
+		}
+	}
+	return recipients
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// manageRoom executes the commands that change the rooms or their members.
+// Every change is broadcasted to all the connected clients so they can keep
+// their list of rooms up to date, the sender also gets a CMD_ACK. Rooms are
+// public: everyone sees them and may join, an invite adds a user without it
+// having to look for the room
+func (hub *hub) manageRoom(message *domain.Message) error {
+	userId := message.Sender.Id
+	switch message.Type {
+	case chatProto.CMD_CREATE_ROOM:
+		name := strings.TrimSpace(string(message.Content))
+		if name == "" {
+			return refuse(chatProto.ERR_BAD_REQUEST, "empty room name")
+		}
+		room := &domain.Room{
+			Id:      uuid.New().String(),
+			Name:    name,
+			Owner:   userId,
+			Members: []string{userId},
+		}
+		hub.mutex.Lock()
+		hub.rooms[room.Id] = room
+		hub.saveRooms()
+		hub.mutex.Unlock()
+		log.Printf("%s created room %s\n", &message.Sender, room)
+		// the ack tells the creator which room it got
+		message.Room = room.Id
+		return hub.updateRoom(room.Id, func(room *domain.Room) error { return nil })
+	case chatProto.CMD_JOIN_ROOM:
+		return hub.updateRoom(message.Room, func(room *domain.Room) error {
+			if !room.HasMember(userId) {
+				room.Members = append(room.Members, userId)
+			}
+			return nil
+		})
+	case chatProto.CMD_LEAVE_ROOM:
+		return hub.updateRoom(message.Room, func(room *domain.Room) error {
+			room.Members = slices.DeleteFunc(room.Members, func(id string) bool { return id == userId })
+			return nil
+		})
+	case chatProto.CMD_INVITE_TO_ROOM:
+		invitee := message.Reciever.Id
+		if !hub.users.isKnown(invitee) {
+			return refuse(chatProto.ERR_UNKNOWN_RECEIVER, "invited user %s does not exist", invitee)
+		}
+		return hub.updateRoom(message.Room, func(room *domain.Room) error {
+			if !room.HasMember(userId) {
+				return refuse(chatProto.ERR_NOT_A_MEMBER, "%s is not a member of room %s", &message.Sender, room)
+			}
+			if !room.HasMember(invitee) {
+				room.Members = append(room.Members, invitee)
+			}
+			return nil
+		})
+	}
+	return refuse(chatProto.ERR_UNKNOWN_COMMAND, "unknown room command %s", message.Type)
+}
+
+// updateRoom applies change to the room under the hub lock and sends the new
+// state of the room to everyone. Rooms without members are removed
+func (hub *hub) updateRoom(roomId string, change func(room *domain.Room) error) error {
+	update, err := hub.changeRoom(roomId, change)
+	if err != nil {
+		return err
+	}
+	hub.broadcast(update, "")
+	return nil
+}
+
+// changeRoom applies change under the hub lock and returns the update to send
+func (hub *hub) changeRoom(roomId string, change func(room *domain.Room) error) (*domain.Message, error) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	room, ok := hub.rooms[roomId]
+	if !ok {
+		return nil, refuse(chatProto.ERR_UNKNOWN_ROOM, "room %s does not exist", roomId)
+	}
+	if err := change(room); err != nil {
+		return nil, err
+	}
+	if len(room.Members) == 0 {
+		log.Printf("removing empty room %s\n", room)
+		delete(hub.rooms, roomId)
+	}
+	hub.saveRooms()
+
+	content, err := json.Marshal(room)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshall room into json %s", err)
+	}
+	return &domain.Message{
+		Type:    chatProto.CMD_ROOM_UPDATED,
+		Room:    roomId,
+		Content: content,
+	}, nil
+}
+
+func (hub *hub) isRoomMember(roomId string, userId string) bool {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	room, ok := hub.rooms[roomId]
+	return ok && room.HasMember(userId)
+}
+
+func (hub *hub) getRooms(message *domain.Message) (*domain.Message, error) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	rooms := make([]*domain.Room, 0, len(hub.rooms))
+	for _, room := range hub.rooms {
+		rooms = append(rooms, room)
+	}
+	slices.SortFunc(rooms, func(a, b *domain.Room) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	content, err := json.Marshal(&rooms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshall msg into json %s", err)
+	}
+	return &domain.Message{
+		Type:     chatProto.CMD_GET_ROOMS_RESPONSE,
+		Reciever: message.Sender,
+		Content:  content,
+	}, nil
+}
+
+// forwardRoomMessage stores the message and fans it out to every member of
+// the room. Members that are offline get it when they connect again
+func (hub *hub) forwardRoomMessage(message *domain.Message) error {
+	recipients, err := hub.roomRecipients(message)
+	if err != nil {
+		return err
+	}
+	for _, member := range recipients {
+		// queued if disconnected in the meantime
+		hub.deliver(member, message)
+	}
+	return nil
+}
+
+// roomRecipients stores the message, queues it for the members that are
+// offline and returns the ids of the members that are online
+func (hub *hub) roomRecipients(message *domain.Message) ([]string, error) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	room, ok := hub.rooms[message.Room]
+	if !ok {
+		return nil, refuse(chatProto.ERR_UNKNOWN_ROOM, "room %s does not exist", message.Room)
+	}
+	if !room.HasMember(message.Sender.Id) {
+		return nil, refuse(chatProto.ERR_NOT_A_MEMBER, "%s is not a member of room %s", &message.Sender, room)
+	}
+	if err := hub.store.Save(message); err != nil {
+		return nil, fmt.Errorf("failed to store message %s", err)
+	}
+
+	recipients := []string{}
+	for _, member := range room.Members {
+		if member == message.Sender.Id {
+			continue
+		}
+		if _, online := hub.clients[member]; online {
+			recipients = append(recipients, member)
+		} else {
+			hub.offline.push(member, message)
+		}
+	}
+	return recipients, nil
+}
+
+// loadRooms reads the rooms saved by saveRooms, there are none yet when path
+// is empty or the file does not exist
+func loadRooms(path string) (map[string]*domain.Room, error) {
+	rooms := make(map[string]*domain.Room)
+	if path == "" {
+		return rooms, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rooms, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rooms %s", err)
+	}
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return nil, fmt.Errorf("failed to unmarshall rooms %s", err)
+	}
+	log.Printf("loaded %d rooms from %s\n", len(rooms), path)
+	return rooms, nil
+}
+
+// saveRooms writes the rooms and their members so their history, kept in the
+// message store, can still be reached after a restart. The caller must hold
+// the mutex
+func (hub *hub) saveRooms() {
+	if hub.roomsPath == "" {
+		return
+	}
+	data, err := json.Marshal(hub.rooms)
+	if err != nil {
+		log.Printf("failed to marshall rooms %s\n", err)
+		return
+	}
+	// write to a temporary file first so a crash never leaves a truncated file
+	tmp := hub.roomsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		log.Printf("failed to write rooms %s\n", err)
+		return
+	}
+	if err := os.Rename(tmp, hub.roomsPath); err != nil {
+		log.Printf("failed to write rooms %s\n", err)
+	}
+}
@@ -11,61 +11,162 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type hub struct {
-	mutex   sync.Mutex
-	clients map[string]*client
+	cfg       config.Config
+	mutex     sync.Mutex
+	clients   map[string][]*client // sessions of each online user, in the order they connected
+	rooms     map[string]*domain.Room
+	roomsPath string // where the rooms are saved, nowhere when empty
+	users     *userRegistry
+	store     messageStore
+	offline   *offlineQueue
+	spilled   *offlineQueue // what slow clients could not take yet, by session
+	admission *admission
+	limiter   *rateLimiter
+	// ids of the online users by lowercase nickname, see claimNickName
+	nickNames map[string]string
 }
 
-type client struct {
-	user      *domain.User
-	writeChan chan *domain.Message
-}
-
-func InitHub() *hub {
+func InitHub(cfg config.Config, users *userRegistry, rooms map[string]*domain.Room, store messageStore, offline *offlineQueue) *hub {
 	return &hub{
-		clients: make(map[string]*client),
+		cfg:       cfg,
+		spilled:   newOfflineQueue("spill", cfg.SpillQueueSize, 0),
+		clients:   make(map[string][]*client),
+		rooms:     rooms,
+		roomsPath: cfg.RoomsPath,
+		users:     users,
+		store:     store,
+		offline:   offline,
+		admission: newAdmission(cfg),
+		limiter:   newRateLimiter(cfg),
+		nickNames: make(map[string]string),
 	}
 }
 
-func (hub *hub) addClient(client *client) {
-	hub.mutex.Lock()
-	defer hub.mutex.Unlock()
-	hub.clients[client.user.Id] = client
-	for id, cli := range hub.clients {
-		if id != client.user.Id {
-			cli.writeChan <- &domain.Message{
-				Type:   chatProto.CMD_USER_CONNECTED,
-				Sender: *client.user,
+// addClient delivers the messages queued while the user was offline and then
+// registers the session. The writer of the client must already be running.
+// The profile of the latest session wins, the sessions already there are
+// updated like after a CMD_UPDATE_PROFILE. It fails when the nickname was
+// taken since the authentication
+func (hub *hub) addClient(client *client) error {
+	user := client.user.Load()
+	var previous *domain.User
+	var count int
+	for {
+		hub.mutex.Lock()
+		queued := hub.offline.take(user.Id)
+		if len(queued) == 0 {
+			// in case the last session of the user released it meanwhile
+			if claimed, _ := hub.claimNickNameLocked(user.Id, user.Name); !claimed {
+				hub.mutex.Unlock()
+				return fmt.Errorf("nickname %s was taken meanwhile", user.Name)
 			}
+			// nothing can be queued anymore once it is registered
+			others := hub.clients[user.Id]
+			hub.clients[user.Id] = append(slices.Clone(others), client)
+			count = len(others) + 1
+			if len(others) > 0 {
+				previous = others[0].user.Load()
+				if !strings.EqualFold(previous.Name, user.Name) {
+					hub.releaseNickName(user.Id, previous.Name)
+				}
+				for _, other := range others {
+					other.user.Store(user)
+				}
+			}
+			hub.mutex.Unlock()
+			break
 		}
+		hub.mutex.Unlock()
+
+		log.Printf("delivering %d queued messages to %s\n", len(queued), user)
+		for _, msg := range queued {
+			client.writeChan <- msg
+		}
+	}
+
+	if previous == nil {
+		if visible(user) {
+			hub.broadcast(&domain.Message{Type: chatProto.CMD_USER_CONNECTED, Sender: *user}, user.Id)
+		}
+		return nil
+	}
+	log.Printf("%s opened session %d\n", user, count)
+	if sameProfile(previous, user) {
+		return nil
 	}
+	hub.announce(previous, user)
+	hub.syncSessions(client, &domain.Message{Type: chatProto.CMD_USER_UPDATED, Sender: *user})
+	return nil
 }
 
+// removeClient unregisters the session. The others only hear that the user is
+// gone with its last session
 func (hub *hub) removeClient(client *client) {
 	hub.mutex.Lock()
-	defer hub.mutex.Unlock()
-	delete(hub.clients, client.user.Id)
-	for _, cli := range hub.clients {
-		cli.writeChan <- &domain.Message{
-			Type:   chatProto.CMD_USER_DISCONNECTED,
-			Sender: *client.user,
+	user := client.user.Load()
+	sessions := slices.Clone(hub.clients[user.Id])
+	if i := slices.Index(sessions, client); i >= 0 {
+		sessions = slices.Delete(sessions, i, i+1)
+	}
+	if len(sessions) > 0 {
+		hub.clients[user.Id] = sessions
+	} else {
+		delete(hub.clients, user.Id)
+		hub.releaseNickName(user.Id, user.Name)
+	}
+	// what did not fit in the send queue was also sent to the other sessions,
+	// without them it waits for the user to come back
+	spilled := hub.spilled.take(client.session)
+	if len(sessions) == 0 {
+		for _, msg := range spilled {
+			hub.offline.push(user.Id, msg)
+		}
+	}
+	hub.mutex.Unlock()
+
+	if len(sessions) == 0 && visible(user) {
+		hub.broadcast(&domain.Message{Type: chatProto.CMD_USER_DISCONNECTED, Sender: *user}, user.Id)
+	}
+}
+
+// broadcast sends the message to every connected client except the one with the given id
+func (hub *hub) broadcast(message *domain.Message, except string) {
+	for _, cli := range hub.connected() {
+		if cli.user.Load().Id != except {
+			hub.send(cli, message)
 		}
 	}
 }
 
+// connected returns a snapshot of the clients so they can be written to
+// without holding the lock
+func (hub *hub) connected() []*client {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	clients := make([]*client, 0, len(hub.clients))
+	for _, sessions := range hub.clients {
+		clients = append(clients, sessions...)
+	}
+	return clients
+}
+
+// getClient returns the first session of the user
 func (hub *hub) getClient(user *domain.User) *client {
 	hub.mutex.Lock()
 	defer hub.mutex.Unlock()
-	if c, ok := hub.clients[user.Id]; !ok {
+	if sessions, ok := hub.clients[user.Id]; !ok {
 		log.Printf("sender with id %s and name %s is not registered\n", user.Id, user.Name)
 		return nil
 	} else {
-		return c
+		return sessions[0]
 	}
 }
 
@@ -78,13 +179,13 @@ func (hub *hub) getActiveUsers(message *domain.Message) (*domain.Message, error)
 		defer hub.mutex.Unlock()
 
 		users := make([]*domain.User, 0, len(hub.clients))
-		for _, cli := range hub.clients {
-			if cli.user.Id != sender.user.Id {
-				users = append(users, cli.user)
+		for _, sessions := range hub.clients {
+			if user := sessions[0].user.Load(); user.Id != sender.user.Load().Id && visible(user) {
+				users = append(users, user)
 			}
 		}
 		var resp domain.Message
-		resp.Sender = *sender.user
+		resp.Sender = *sender.user.Load()
 		resp.Type = chatProto.CMD_GET_USERS_RESPONSE
 		// sort users alphabetically
 		slices.SortFunc(users, func(a, b *domain.User) int {
@@ -104,85 +205,359 @@ func (hub *hub) getActiveUsers(message *domain.Message) (*domain.Message, error)
 	}
 }
 
-func (hub *hub) forwardMessage(message *domain.Message) {
-	if sender := hub.getClient(&message.Sender); sender == nil {
-		return
+func (hub *hub) getHistory(message *domain.Message) (*domain.Message, error) {
+	sender := hub.getClient(&message.Sender)
+	if sender == nil {
+		return nil, fmt.Errorf("failed to return history. Sender not found")
+	}
+
+	query := domain.HistoryQuery{Limit: chatProto.HISTORY_PAGE_SIZE}
+	if len(message.Content) > 0 {
+		if err := json.Unmarshal(message.Content, &query); err != nil {
+			return nil, refuse(chatProto.ERR_BAD_REQUEST, "failed to unmarshall history query %s", err)
+		}
+	}
+	if query.Limit <= 0 || query.Limit > chatProto.HISTORY_PAGE_SIZE {
+		query.Limit = chatProto.HISTORY_PAGE_SIZE
+	}
+	query.Offset = max(query.Offset, 0)
+
+	conversation := conversationKey(sender.user.Load().Id, message.Reciever.Id)
+	if message.Room != "" {
+		if !hub.isRoomMember(message.Room, sender.user.Load().Id) {
+			return nil, refuse(chatProto.ERR_NOT_A_MEMBER, "failed to return history. %s is not a member of room %s", sender.user.Load(), message.Room)
+		}
+		conversation = roomKey(message.Room)
+	}
+	var messages []*domain.Message
+	var more bool
+	var err error
+	if query.After > 0 {
+		messages, more, err = hub.store.Since(conversation, query.After, query.Limit)
 	} else {
-		if receiver := hub.getClient(&message.Reciever); receiver == nil {
-			log.Printf("failed to send message. Receiver does not exist")
+		messages, more, err = hub.store.History(conversation, query.Offset, query.Limit)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history %s", err)
+	}
+	page := domain.HistoryPage{Offset: query.Offset, After: query.After, Messages: messages, More: more}
+	content, err := json.Marshal(&page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshall msg into json %s", err)
+	}
+	return &domain.Message{
+		Type:     chatProto.CMD_GET_HISTORY_RESPONSE,
+		Sender:   *sender.user.Load(),
+		Reciever: message.Reciever,
+		Room:     message.Room,
+		Content:  content,
+	}, nil
+}
+
+func (hub *hub) forwardMessage(message *domain.Message) error {
+	if sender := hub.getClient(&message.Sender); sender == nil {
+		return fmt.Errorf("sender %s is not registered", &message.Sender)
+	}
+	if !hub.users.isKnown(message.Reciever.Id) {
+		return refuse(chatProto.ERR_UNKNOWN_RECEIVER, "receiver %s does not exist", &message.Reciever)
+	}
+	// a message that is not stored is not delivered, its sequence number may come again
+	if err := hub.store.Save(message); err != nil {
+		return fmt.Errorf("failed to store message %s", err)
+	}
+	hub.deliver(message.Reciever.Id, message)
+	return nil
+}
+
+// deliver sends the message to every session of the user or queues it until
+// the user is back online
+func (hub *hub) deliver(userId string, message *domain.Message) {
+	// the lookup and the queueing must happen under the same lock as addClient
+	// otherwise a message could be queued right after the receiver took its queue
+	hub.mutex.Lock()
+	sessions := hub.clients[userId]
+	if len(sessions) == 0 {
+		hub.offline.push(userId, message)
+	}
+	hub.mutex.Unlock()
+
+	for len(sessions) > 0 {
+		accepted := false
+		for _, session := range sessions {
+			if hub.send(session, message) {
+				accepted = true
+			}
+		}
+		if accepted {
 			return
-		} else {
-			receiver.writeChan <- message
+		}
+		// all disconnected in the meantime. Sessions that connected since then
+		// get it instead, otherwise it is queued under the lock like above
+		hub.mutex.Lock()
+		tried := sessions
+		sessions = slices.DeleteFunc(slices.Clone(hub.clients[userId]), func(session *client) bool {
+			return slices.Contains(tried, session)
+		})
+		if len(sessions) == 0 {
+			hub.offline.push(userId, message)
+		}
+		hub.mutex.Unlock()
+	}
+}
+
+// writeLoop writes the messages of the client to its connection and pings it
+// regularly. It returns once the write channel is closed
+func (hub *hub) writeLoop(c *websocket.Conn, client *client) {
+	pings, stop := domain.Heartbeat(hub.cfg.PingInterval)
+	defer stop()
+
+	for {
+		select {
+		case msg, ok := <-client.writeChan:
+			if !ok {
+				return
+			}
+			if err := hub.write(client, msg); err != nil {
+				log.Printf("failed writing json to websocket: %s\n", err)
+				discard(c, client)
+				return
+			}
+			if len(client.writeChan) > 0 {
+				continue
+			}
+			// caught up, now what did not fit in the queue can be sent
+			for _, spilled := range hub.takeSpilled(client) {
+				if err := hub.write(client, spilled); err != nil {
+					log.Printf("failed writing json to websocket: %s\n", err)
+					discard(c, client)
+					return
+				}
+			}
+		case <-pings:
+			if err := domain.Ping(c); err != nil {
+				log.Printf("failed to ping %s: %s\n", client.user.Load(), err)
+				discard(c, client)
+				return
+			}
 		}
 	}
 }
 
+func (hub *hub) write(client *client, msg *domain.Message) error {
+	client.conn.SetWriteDeadline(time.Now().Add(chatProto.WRITE_TIMEOUT))
+	if err := writeMessage(client.conn, client.codec, msg); err != nil {
+		return err
+	}
+	// copies synced to the other sessions of the sender were not delivered to anyone
+	if msg.Type == chatProto.CMD_SEND_MSG_SINGLE && msg.Id != "" && client.user.Load().Id == msg.Reciever.Id {
+		hub.notifyDelivered(msg)
+	}
+	return nil
+}
+
+// answer ties the response to the request of the client it answers
+func answer(request *domain.Message, response *domain.Message) *domain.Message {
+	response.RequestId = request.RequestId
+	return response
+}
+
+// discard closes a connection that can't be written to anymore so its read
+// loop stops, and drains the channel until it is closed so nobody blocks on it
+func discard(c *websocket.Conn, client *client) {
+	c.Close()
+	for range client.writeChan {
+	}
+}
+
 func (hub *hub) startChatServer(addr string) {
-	log.Printf("chat server listening on %s\n", addr)
 
-	var upgrader = websocket.Upgrader{}
+	// permessage-deflate is only used when the client asks for it too
+	var upgrader = websocket.Upgrader{
+		EnableCompression: hub.cfg.Compression,
+		CheckOrigin:       hub.admission.checkOrigin,
+	}
+
+	http.HandleFunc(chatProto.AVATAR_PATH, hub.serveAvatar)
 
 	http.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
+		release, err := hub.admission.admit(r)
+		if err != nil {
+			log.Printf("refused connection from %s: %s\n", r.RemoteAddr, err)
+			metrics.Add("connections_refused", 1)
+			refused := err.(*admissionError)
+			http.Error(w, refused.reason, refused.status)
+			return
+		}
+		defer release()
+
 		// upgrade the connection from http to websocket
-		c, err := upgrader.Upgrade(w, r, nil)
+		c, err := upgrader.Upgrade(countingWriter{w}, r, nil)
 		if err != nil {
 			log.Printf("upgrade: %s\n", err)
 			return
 		}
+		// bigger frames close the connection, see MaxFrameSize
+		c.SetReadLimit(int64(hub.cfg.MaxFrameSize))
+		if hub.cfg.Compression {
+			if err := c.SetCompressionLevel(hub.cfg.CompressionLevel); err != nil {
+				log.Printf("failed to set compression level %d: %s\n", hub.cfg.CompressionLevel, err)
+			}
+		}
 		defer c.Close()
 
-		// get the user from the client and save it
-		var user domain.User
-		err = c.ReadJSON(&user)
+		// agree on the protocol with the client and learn who it claims to be
+		user, agreed, err := hub.hello(c)
 		if err != nil {
-			log.Printf("failed reading user data %s\n", err)
+			log.Printf("failed handshake with %s: %s\n", c.RemoteAddr(), err)
 			return
 		}
-
-		client := &client{
-			user:      &user,
-			writeChan: make(chan *domain.Message),
+		// the hash is computed here, a client could lie about it
+		user.AvatarHash = domain.AvatarHash(user.Avatar)
+		if err := hub.authenticate(c, user); err != nil {
+			log.Printf("failed to authenticate %s: %s\n", user, err)
+			return
 		}
-		hub.addClient(client)
+
+		// other clients only get a reference and fetch the avatar by its hash
+		ref := user.Ref()
+		client := newClient(&ref, c, hub.cfg, agreed)
 
 		// this gorutine checks if other clients want to send message to this connection
 		// and if so it will send them
-		go func() {
-			for msg := range client.writeChan {
-				err := c.WriteJSON(msg)
-				if err != nil {
-					log.Printf("failed writing json to websocket: %s\n", err)
-					break
-				}
-			}
-		}()
+		go hub.writeLoop(c, client)
+
+		// a client that stops answering pings is evicted when the read below fails
+		domain.ExpectPongs(c, hub.cfg.PongTimeout)
+		if err := hub.addClient(client); err != nil {
+			log.Printf("failed to add %s: %s\n", user, err)
+			// the client reconnects and is told by the authentication
+			closing := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+			c.WriteControl(websocket.CloseMessage, closing, time.Now().Add(chatProto.WRITE_TIMEOUT))
+			client.close()
+			return
+		}
 
 		// in this loop we read messages from clients and process them
-		var message domain.Message
 		for {
-			err := c.ReadJSON(&message)
+			var message domain.Message
+			err := readMessage(c, client.codec, hub.cfg.MaxFrameSize, &message)
 			if err != nil {
 				log.Printf("failed websocket read: %s\n", err)
 				break
 			}
+			// only trust the identity that went through the handshake
+			message.Sender = *client.user.Load()
+			message.Reciever = message.Reciever.Ref()
+			// the request id only means something to this client, it must not
+			// reach the others nor the store
+			request := message
+			message.RequestId = ""
+			if disconnect, err := hub.limiter.allow(client, &message); err != nil {
+				if disconnect {
+					// queued frames are lost with the connection, the close frame tells why
+					closing := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+					c.WriteControl(websocket.CloseMessage, closing, time.Now().Add(chatProto.WRITE_TIMEOUT))
+					break
+				}
+				hub.reply(client, errorFrame(&request, err))
+				continue
+			}
 			switch message.Type {
 			case chatProto.CMD_GET_USERS:
 				resp, err := hub.getActiveUsers(&message)
 				if err != nil {
 					log.Printf("failed to get active users %s\n", err)
+					hub.reply(client, errorFrame(&request, err))
 					continue
 				}
-				c.WriteJSON(resp)
+				hub.reply(client, answer(&request, resp))
+			case chatProto.CMD_GET_HISTORY:
+				resp, err := hub.getHistory(&message)
+				if err != nil {
+					log.Printf("failed to get history %s\n", err)
+					hub.reply(client, errorFrame(&request, err))
+					continue
+				}
+				hub.reply(client, answer(&request, resp))
 			case chatProto.CMD_SEND_MSG_SINGLE:
 				//log.Printf("SEND MESSAGE TRIGGERED BY %s TO %s\n", message.Sender.Name, message.Reciever.Name)
-				hub.forwardMessage(&message)
+				if err := hub.forwardMessage(&message); err != nil {
+					log.Printf("failed to send message %s\n", err)
+					hub.reply(client, errorFrame(&request, err))
+					continue
+				}
+				hub.reply(client, answer(&request, ack(&message)))
+				hub.syncSessions(client, &message)
+			case chatProto.CMD_SEND_MSG_ROOM:
+				if err := hub.forwardRoomMessage(&message); err != nil {
+					log.Printf("failed to send room message %s\n", err)
+					hub.reply(client, errorFrame(&request, err))
+					continue
+				}
+				hub.reply(client, answer(&request, ack(&message)))
+				hub.syncSessions(client, &message)
+			case chatProto.CMD_READ:
+				hub.forwardReadReceipt(&message)
+			case chatProto.CMD_TYPING:
+				hub.relayTyping(&message)
+			case chatProto.CMD_CHANGE_NICK:
+				resp, err := hub.changeNickName(client, &message)
+				if err != nil {
+					log.Printf("failed to change nickname %s\n", err)
+					hub.reply(client, errorFrame(&request, err))
+					continue
+				}
+				hub.reply(client, answer(&request, resp))
+			case chatProto.CMD_UPDATE_PROFILE:
+				resp, err := hub.changeProfile(client, &message)
+				if err != nil {
+					log.Printf("failed to update profile %s\n", err)
+					hub.reply(client, errorFrame(&request, err))
+					continue
+				}
+				hub.reply(client, answer(&request, resp))
+			case chatProto.CMD_SET_PRESENCE:
+				resp, err := hub.setPresence(client, &message)
+				if err != nil {
+					log.Printf("failed to set presence %s\n", err)
+					hub.reply(client, errorFrame(&request, err))
+					continue
+				}
+				hub.reply(client, answer(&request, resp))
+			case chatProto.CMD_GET_ROOMS:
+				resp, err := hub.getRooms(&message)
+				if err != nil {
+					log.Printf("failed to get rooms %s\n", err)
+					hub.reply(client, errorFrame(&request, err))
+					continue
+				}
+				hub.reply(client, answer(&request, resp))
+			case chatProto.CMD_CREATE_ROOM, chatProto.CMD_JOIN_ROOM, chatProto.CMD_LEAVE_ROOM, chatProto.CMD_INVITE_TO_ROOM:
+				if err := hub.manageRoom(&message); err != nil {
+					log.Printf("failed to execute %s %s\n", message.Type, err)
+					hub.reply(client, errorFrame(&request, err))
+					continue
+				}
+				hub.reply(client, answer(&request, ack(&message)))
+			default:
+				hub.reply(client, errorFrame(&request, refuse(chatProto.ERR_UNKNOWN_COMMAND, "unknown command %s", message.Type)))
 			}
 		}
 		hub.removeClient(client)
-		close(client.writeChan)
+		client.close()
 	})
 
-	http.ListenAndServe(addr, nil)
+	// wss is served directly when a certificate is configured, otherwise TLS
+	// is left to a proxy in front like in nginx-websocket.conf
+	var err error
+	if hub.cfg.TLSCert != "" || hub.cfg.TLSKey != "" {
+		log.Printf("chat server listening on %s with TLS\n", addr)
+		err = http.ListenAndServeTLS(addr, hub.cfg.TLSCert, hub.cfg.TLSKey, nil)
+	} else {
+		log.Printf("chat server listening on %s\n", addr)
+		err = http.ListenAndServe(addr, nil)
+	}
+	log.Fatalf("failed to serve %s\n", err)
 }
 
 func main() {
@@ -194,6 +569,24 @@ func main() {
 	log.SetOutput(f)
 
 	cfg := config.ReadServerConfig()
-	hub := InitHub()
+	store, err := newMessageStore(cfg)
+	if err != nil {
+		log.Fatalf("failed to open message store %s\n", err)
+	}
+	defer store.Close()
+	usersPath := cfg.UsersPath
+	if cfg.Store == "memory" {
+		usersPath = ""
+		cfg.RoomsPath = ""
+	}
+	users, err := openUserRegistry(usersPath)
+	if err != nil {
+		log.Fatalf("failed to open user registry %s\n", err)
+	}
+	rooms, err := loadRooms(cfg.RoomsPath)
+	if err != nil {
+		log.Fatalf("failed to load rooms %s\n", err)
+	}
+	hub := InitHub(cfg, users, rooms, store, newOfflineQueue("offline", cfg.OfflineQueueSize, cfg.OfflineQueueTTL))
 	hub.startChatServer(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port))
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"example/zerochat/client/config"
+	"testing"
+)
+
+// connect registers a session of the user that agreed on every capability,
+// its frames stay in its write queue
+func connect(t *testing.T, hub *hub, user *domain.User) *client {
+	t.Helper()
+	agreed := &domain.Hello{Version: chatProto.PROTOCOL_VERSION, Capabilities: chatProto.CAPABILITIES, Codecs: []string{chatProto.CODEC_JSON}}
+	cli := newClient(user, nil, hub.cfg, agreed)
+	if err := hub.addClient(cli); err != nil {
+		t.Fatalf("failed to add client %s", err)
+	}
+	return cli
+}
+
+func TestDeliverToEverySession(t *testing.T) {
+	bob := &domain.User{Id: "bob", Name: "bob"}
+	message := &domain.Message{Id: "1", Type: chatProto.CMD_SEND_MSG_SINGLE, Reciever: *bob, Content: []byte("hi")}
+	tests := []struct {
+		name   string
+		closed []bool
+		// frames in the write queue of each session
+		want    []int
+		offline int
+	}{
+		{"one session", []bool{false}, []int{1}, 0},
+		{"two sessions", []bool{false, false}, []int{1, 1}, 0},
+		{"one session gone", []bool{true, false}, []int{0, 1}, 0},
+		{"all sessions gone", []bool{true, true}, []int{0, 0}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hub := InitHub(config.DefaultServerConfig(), nil, nil, newMemoryStore(), newOfflineQueue("offline", 10, 0))
+			sessions := []*client{}
+			for _, closed := range test.closed {
+				session := connect(t, hub, bob)
+				if closed {
+					session.close()
+				}
+				sessions = append(sessions, session)
+			}
+
+			hub.deliver(bob.Id, message)
+
+			for i, session := range sessions {
+				if got := len(session.writeChan); got != test.want[i] {
+					t.Errorf("session %d got %d frames, want %d", i+1, got, test.want[i])
+				}
+			}
+			if got := len(hub.offline.take(bob.Id)); got != test.offline {
+				t.Errorf("got %d queued messages, want %d", got, test.offline)
+			}
+		})
+	}
+}
+
+func TestReceiptsAreNotQueued(t *testing.T) {
+	hub := InitHub(config.DefaultServerConfig(), nil, nil, newMemoryStore(), newOfflineQueue("offline", 10, 0))
+	alice := &domain.User{Id: "alice", Name: "alice"}
+	bob := &domain.User{Id: "bob", Name: "bob"}
+	message := &domain.Message{Id: "1", Type: chatProto.CMD_SEND_MSG_SINGLE, Sender: *alice, Reciever: *bob}
+
+	hub.notifyDelivered(message)
+	if got := len(hub.offline.take(alice.Id)); got != 0 {
+		t.Errorf("got %d queued receipts for an offline sender, want none", got)
+	}
+
+	sessions := []*client{connect(t, hub, alice), connect(t, hub, alice)}
+	hub.notifyDelivered(message)
+	for i, session := range sessions {
+		if got := len(session.writeChan); got != 1 {
+			t.Errorf("session %d got %d receipts, want 1", i+1, got)
+		}
+	}
+}
+
+func TestReplyFollowsSlowConsumerPolicy(t *testing.T) {
+	cfg := config.DefaultServerConfig()
+	cfg.SendQueueSize = 1
+	cfg.SlowConsumerPolicy = SLOW_CONSUMER_SPILL
+	hub := InitHub(cfg, nil, nil, newMemoryStore(), newOfflineQueue("offline", 10, 0))
+	alice := connect(t, hub, &domain.User{Id: "alice", Name: "alice"})
+
+	message := &domain.Message{Id: "1", Type: chatProto.CMD_SEND_MSG_SINGLE}
+	spilled := &domain.Message{Id: "2", Type: chatProto.CMD_SEND_MSG_SINGLE}
+	response := &domain.Message{Type: chatProto.CMD_ACK, Id: "3"}
+	hub.send(alice, message)
+	hub.send(alice, spilled)
+	if !hub.reply(alice, response) {
+		t.Fatalf("reply refused by a spilling client")
+	}
+	if got := len(alice.writeChan); got != 1 {
+		t.Errorf("got %d frames in the write queue, want 1", got)
+	}
+	// the response waits behind what was spilled before it
+	if got := hub.takeSpilled(alice); len(got) != 2 || got[0] != spilled || got[1] != response {
+		t.Errorf("got %v spilled, want the message then the response", got)
+	}
+
+	alice.close()
+	if hub.reply(alice, response) {
+		t.Errorf("reply accepted by a closed client")
+	}
+}
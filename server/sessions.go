@@ -0,0 +1,42 @@
+package main
+
+import (
+	"example/zerochat/chatProto/domain"
+)
+
+// syncSessions sends a copy of what the client sent to the other sessions of
+// its user, so every device shows the whole conversation
+func (hub *hub) syncSessions(client *client, message *domain.Message) {
+	hub.mutex.Lock()
+	sessions := hub.clients[client.user.Load().Id]
+	hub.mutex.Unlock()
+
+	for _, session := range sessions {
+		if session != client {
+			hub.send(session, message)
+		}
+	}
+}
+
+// replaceUser changes the user of every session of the client's user, they
+// must all see the same user. change gets a copy and runs with the mutex held.
+// It returns the user before and after the change
+func (hub *hub) replaceUser(client *client, change func(user *domain.User)) (*domain.User, *domain.User) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	previous := client.user.Load()
+	// the user is replaced, never changed, others may be reading it
+	updated := *previous
+	change(&updated)
+	for _, session := range hub.clients[previous.Id] {
+		session.user.Store(&updated)
+	}
+	client.user.Store(&updated)
+	return previous, &updated
+}
+
+// sameProfile reports if the others would not notice the difference between
+// the two users
+func sameProfile(a *domain.User, b *domain.User) bool {
+	return a.Name == b.Name && a.AvatarHash == b.AvatarHash && a.Presence == b.Presence && a.StatusText == b.StatusText
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"example/zerochat/chatProto/domain"
+	"example/zerochat/client/config"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// messageStore keeps every message accepted by the hub so conversations
+// can be replayed to clients later on
+type messageStore interface {
+	// Save stamps the message with the server time and the next sequence
+	// number of its conversation before keeping it
+	Save(message *domain.Message) error
+	// History returns up to limit messages of the conversation, oldest first,
+	// skipping the newest offset ones. The bool reports if older messages are
+	// still available
+	History(conversation string, offset, limit int) ([]*domain.Message, bool, error)
+	// Since returns up to limit messages of the conversation that follow the
+	// sequence number after, oldest first. The bool reports if newer messages
+	// are still available
+	Since(conversation string, after uint64, limit int) ([]*domain.Message, bool, error)
+	Close() error
+}
+
+// conversationKey identifies the private conversation between two users
+func conversationKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%s:%s", a, b)
+}
+
+func roomKey(roomId string) string {
+	return fmt.Sprintf("room:%s", roomId)
+}
+
+func conversationOf(message *domain.Message) string {
+	if message.Room != "" {
+		return roomKey(message.Room)
+	}
+	return conversationKey(message.Sender.Id, message.Reciever.Id)
+}
+
+func newMessageStore(cfg config.Config) (messageStore, error) {
+	switch cfg.Store {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file", "":
+		return openFileStore(cfg.StorePath)
+	default:
+		return nil, fmt.Errorf("unknown message store %q", cfg.Store)
+	}
+}
+
+type memoryStore struct {
+	mutex         sync.Mutex
+	conversations map[string][]*domain.Message
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		conversations: make(map[string][]*domain.Message),
+	}
+}
+
+// add appends the message to its conversation. The caller must hold the mutex
+func (store *memoryStore) add(message *domain.Message) {
+	key := conversationOf(message)
+	store.conversations[key] = append(store.conversations[key], message)
+}
+
+// stamp sets the time and the sequence number of a new message. Sequence
+// numbers start at 1 and never repeat within a conversation. The caller must
+// hold the mutex
+func (store *memoryStore) stamp(message *domain.Message) {
+	message.Timestamp = time.Now().UTC()
+	message.Seq = store.lastSeq(conversationOf(message)) + 1
+}
+
+func (store *memoryStore) lastSeq(conversation string) uint64 {
+	messages := store.conversations[conversation]
+	if len(messages) == 0 {
+		return 0
+	}
+	return messages[len(messages)-1].Seq
+}
+
+func (store *memoryStore) Save(message *domain.Message) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.stamp(message)
+	store.add(stripAvatars(message))
+	return nil
+}
+
+func (store *memoryStore) History(conversation string, offset, limit int) ([]*domain.Message, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	messages := store.conversations[conversation]
+	end := max(len(messages)-offset, 0)
+	start := max(end-limit, 0)
+	page := make([]*domain.Message, end-start)
+	copy(page, messages[start:end])
+	return page, start > 0, nil
+}
+
+func (store *memoryStore) Since(conversation string, after uint64, limit int) ([]*domain.Message, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	messages := store.conversations[conversation]
+	start := sort.Search(len(messages), func(i int) bool { return messages[i].Seq > after })
+	end := min(start+limit, len(messages))
+	page := make([]*domain.Message, end-start)
+	copy(page, messages[start:end])
+	return page, end < len(messages), nil
+}
+
+func (store *memoryStore) Close() error {
+	return nil
+}
+
+// fileStore is an append only log with one json encoded message per line.
+// The whole log is loaded in memory when the server starts
+type fileStore struct {
+	*memoryStore
+	file    *os.File
+	encoder *json.Encoder
+	// set when a partial write could not be undone, messages appended after
+	// it would be lost on the next start
+	broken error
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message log %s", err)
+	}
+
+	store := &fileStore{
+		memoryStore: newMemoryStore(),
+		file:        file,
+		encoder:     json.NewEncoder(file),
+	}
+
+	decoder := json.NewDecoder(file)
+	count := 0
+	// end of the last message read
+	var good int64
+	for {
+		var message domain.Message
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a crash while writing can leave a truncated last line behind,
+			// new messages must not be appended after it
+			log.Printf("stopped reading message log after %d messages: %s\n", count, err)
+			if err := truncateLog(file, good); err != nil {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		good = decoder.InputOffset()
+		// logs written before sequence numbers existed are numbered in order
+		if message.Seq == 0 {
+			message.Seq = store.lastSeq(conversationOf(&message)) + 1
+		}
+		store.add(&message)
+		count++
+	}
+	log.Printf("loaded %d messages from %s\n", count, path)
+	return store, nil
+}
+
+// truncateLog drops what follows the last message read, at offset
+func truncateLog(file *os.File, offset int64) error {
+	if err := file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate message log %s", err)
+	}
+	if offset == 0 {
+		return nil
+	}
+	// the offset is right after the message, before its new line
+	if _, err := file.WriteString("\n"); err != nil {
+		return fmt.Errorf("failed to truncate message log %s", err)
+	}
+	return nil
+}
+
+func (store *fileStore) Save(message *domain.Message) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.broken != nil {
+		return store.broken
+	}
+	// where the message starts, a partial write is cut off there
+	offset, err := store.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to append to message log %s", err)
+	}
+	// the sequence number is only taken once the message is written, the
+	// next message would get the same one otherwise
+	stripped := stripAvatars(message)
+	store.stamp(stripped)
+	if err := store.encoder.Encode(stripped); err != nil {
+		if err := store.file.Truncate(offset); err != nil {
+			store.broken = fmt.Errorf("message log is damaged, failed to truncate it %s", err)
+		}
+		return fmt.Errorf("failed to append to message log %s", err)
+	}
+	message.Timestamp = stripped.Timestamp
+	message.Seq = stripped.Seq
+	store.add(stripped)
+	return nil
+}
+
+func (store *fileStore) Close() error {
+	return store.file.Close()
+}
+
+// stripAvatars returns a copy of the message without the avatar images
+// of the users since those are not needed to replay a conversation
+func stripAvatars(message *domain.Message) *domain.Message {
+	stripped := *message
+	stripped.Sender.Avatar = nil
+	stripped.Reciever.Avatar = nil
+	return &stripped
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"example/zerochat/chatProto"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// filledStore returns a memory store with count messages from alice to bob
+func filledStore(t *testing.T, count int) *memoryStore {
+	t.Helper()
+	store := newMemoryStore()
+	for i := 1; i <= count; i++ {
+		msg := &domain.Message{
+			Type:     chatProto.CMD_SEND_MSG_SINGLE,
+			Sender:   domain.User{Id: "alice"},
+			Reciever: domain.User{Id: "bob"},
+			Content:  []byte(fmt.Sprint(i)),
+		}
+		if err := store.Save(msg); err != nil {
+			t.Fatalf("failed to save %s", err)
+		}
+		if msg.Seq != uint64(i) {
+			t.Fatalf("message %d got sequence number %d", i, msg.Seq)
+		}
+	}
+	return store
+}
+
+// seqs lists the sequence numbers of the messages
+func seqs(messages []*domain.Message) []uint64 {
+	numbers := []uint64{}
+	for _, msg := range messages {
+		numbers = append(numbers, msg.Seq)
+	}
+	return numbers
+}
+
+func TestMemoryStoreHistory(t *testing.T) {
+	store := filledStore(t, 5)
+	tests := []struct {
+		offset, limit int
+		want          []uint64
+		more          bool
+	}{
+		{0, 2, []uint64{4, 5}, true},
+		{2, 2, []uint64{2, 3}, true},
+		{4, 2, []uint64{1}, false},
+		{0, 5, []uint64{1, 2, 3, 4, 5}, false},
+		{0, 10, []uint64{1, 2, 3, 4, 5}, false},
+		{5, 2, []uint64{}, false},
+		{10, 2, []uint64{}, false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("offset %d limit %d", test.offset, test.limit), func(t *testing.T) {
+			page, more, err := store.History(conversationKey("bob", "alice"), test.offset, test.limit)
+			if err != nil {
+				t.Fatalf("failed to read history %s", err)
+			}
+			if fmt.Sprint(seqs(page)) != fmt.Sprint(test.want) || more != test.more {
+				t.Errorf("got %v more %v, want %v more %v", seqs(page), more, test.want, test.more)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSince(t *testing.T) {
+	store := filledStore(t, 5)
+	tests := []struct {
+		after uint64
+		limit int
+		want  []uint64
+		more  bool
+	}{
+		{0, 2, []uint64{1, 2}, true},
+		{2, 2, []uint64{3, 4}, true},
+		{3, 2, []uint64{4, 5}, false},
+		{0, 10, []uint64{1, 2, 3, 4, 5}, false},
+		{5, 2, []uint64{}, false},
+		{9, 2, []uint64{}, false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("after %d limit %d", test.after, test.limit), func(t *testing.T) {
+			page, more, err := store.Since(conversationKey("alice", "bob"), test.after, test.limit)
+			if err != nil {
+				t.Fatalf("failed to read history %s", err)
+			}
+			if fmt.Sprint(seqs(page)) != fmt.Sprint(test.want) || more != test.more {
+				t.Errorf("got %v more %v, want %v more %v", seqs(page), more, test.want, test.more)
+			}
+		})
+	}
+}
+
+func TestFileStoreTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.log")
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store %s", err)
+	}
+	msg := &domain.Message{Type: chatProto.CMD_SEND_MSG_SINGLE, Sender: domain.User{Id: "alice"}, Reciever: domain.User{Id: "bob"}}
+	if err := store.Save(msg); err != nil {
+		t.Fatalf("failed to save %s", err)
+	}
+	store.Close()
+
+	// a crash in the middle of a write
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Id":"","Type":"SEND_MS`)
+	file.Close()
+
+	store, err = openFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store %s", err)
+	}
+	next := *msg
+	if err := store.Save(&next); err != nil {
+		t.Fatalf("failed to save %s", err)
+	}
+	store.Close()
+
+	store, err = openFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store %s", err)
+	}
+	defer store.Close()
+	page, _, _ := store.History(conversationKey("alice", "bob"), 0, 10)
+	if fmt.Sprint(seqs(page)) != "[1 2]" {
+		t.Errorf("got %v after reopening, want [1 2]", seqs(page))
+	}
+}
+
+// failingWriter writes the first size bytes and fails after, like a full disk
+type failingWriter struct {
+	file *os.File
+	size int
+}
+
+func (writer *failingWriter) Write(data []byte) (int, error) {
+	n, _ := writer.file.Write(data[:min(len(data), writer.size)])
+	return n, fmt.Errorf("no space left on device")
+}
+
+func TestFileStorePartialWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.log")
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store %s", err)
+	}
+	msg := &domain.Message{Type: chatProto.CMD_SEND_MSG_SINGLE, Sender: domain.User{Id: "alice"}, Reciever: domain.User{Id: "bob"}}
+	if err := store.Save(msg); err != nil {
+		t.Fatalf("failed to save %s", err)
+	}
+
+	encoder := store.encoder
+	store.encoder = json.NewEncoder(&failingWriter{file: store.file, size: 10})
+	failed := *msg
+	if err := store.Save(&failed); err == nil {
+		t.Fatalf("no error for a partial write")
+	}
+	store.encoder = encoder
+	next := *msg
+	if err := store.Save(&next); err != nil {
+		t.Fatalf("failed to save %s", err)
+	}
+	store.Close()
+
+	store, err = openFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store %s", err)
+	}
+	defer store.Close()
+	page, _, _ := store.History(conversationKey("alice", "bob"), 0, 10)
+	if fmt.Sprint(seqs(page)) != "[1 2]" {
+		t.Errorf("got %v after reopening, want [1 2]", seqs(page))
+	}
+}
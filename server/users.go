@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"example/zerochat/chatProto/domain"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// userRegistry remembers every user that connected at least once so returning
+// users keep their conversations. When path is empty nothing is persisted
+type userRegistry struct {
+	mutex sync.Mutex
+	path  string
+	users map[string]*domain.User
+	// avatars of the users, keyed by their hash
+	avatars map[string][]byte
+}
+
+func openUserRegistry(path string) (*userRegistry, error) {
+	registry := &userRegistry{
+		path:    path,
+		users:   make(map[string]*domain.User),
+		avatars: make(map[string][]byte),
+	}
+	if path == "" {
+		return registry, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users %s", err)
+	}
+	if err := json.Unmarshal(data, &registry.users); err != nil {
+		return nil, fmt.Errorf("failed to unmarshall users %s", err)
+	}
+	for _, user := range registry.users {
+		// registries saved before avatars were addressed by hash
+		user.AvatarHash = domain.AvatarHash(user.Avatar)
+		registry.addAvatar(user)
+	}
+	log.Printf("loaded %d known users from %s\n", len(registry.users), path)
+	return registry, nil
+}
+
+// checkKey refuses a user claiming a known id with a different key
+func (registry *userRegistry) checkKey(user *domain.User) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if known, ok := registry.users[user.Id]; ok && !bytes.Equal(known.PublicKey, user.PublicKey) {
+		return fmt.Errorf("public key of %s does not match the registered one", user)
+	}
+	return nil
+}
+
+// register records the user or updates the profile of a returning one.
+// The public key of a user is remembered the first time it is seen and
+// a user claiming a known id with a different key is refused
+func (registry *userRegistry) register(user *domain.User) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if known, ok := registry.users[user.Id]; ok {
+		if !bytes.Equal(known.PublicKey, user.PublicKey) {
+			return fmt.Errorf("public key of %s does not match the registered one", user)
+		}
+		log.Printf("returning user %s\n", user)
+	}
+	registry.users[user.Id] = user
+	registry.addAvatar(user)
+	if err := registry.save(); err != nil {
+		log.Printf("failed to persist user registry %s\n", err)
+	}
+	return nil
+}
+
+// profile returns what the user can change about itself
+func (registry *userRegistry) profile(id string) (*domain.Profile, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	known, ok := registry.users[id]
+	if !ok {
+		return nil, false
+	}
+	return &domain.Profile{Name: known.Name, Avatar: known.Avatar}, true
+}
+
+// updateProfile changes the nickname and the avatar of a known user
+func (registry *userRegistry) updateProfile(id string, profile *domain.Profile) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	known, ok := registry.users[id]
+	if !ok {
+		return fmt.Errorf("unknown user %s", id)
+	}
+	updated := *known
+	updated.Name = profile.Name
+	updated.Avatar = profile.Avatar
+	updated.AvatarHash = domain.AvatarHash(profile.Avatar)
+	registry.users[id] = &updated
+	registry.addAvatar(&updated)
+	return registry.save()
+}
+
+func (registry *userRegistry) isKnown(id string) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	_, ok := registry.users[id]
+	return ok
+}
+
+// avatar returns the avatar with the hash
+func (registry *userRegistry) avatar(hash string) ([]byte, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	avatar, ok := registry.avatars[hash]
+	return avatar, ok
+}
+
+// addAvatar indexes the avatar of the user. Previous avatars stay available
+// for the clients that still reference them. The caller must hold the mutex
+func (registry *userRegistry) addAvatar(user *domain.User) {
+	if user.AvatarHash != "" {
+		registry.avatars[user.AvatarHash] = user.Avatar
+	}
+}
+
+// save writes the registry to disk. The caller must hold the mutex
+func (registry *userRegistry) save() error {
+	if registry.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(registry.users)
+	if err != nil {
+		return fmt.Errorf("failed to marshall users %s", err)
+	}
+	// write to a temporary file first so a crash never leaves a truncated registry
+	tmp := registry.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		return fmt.Errorf("failed to write users %s", err)
+	}
+	if err := os.Rename(tmp, registry.path); err != nil {
+		return fmt.Errorf("failed to write users %s", err)
+	}
+	return nil
+}